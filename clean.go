@@ -17,7 +17,9 @@ package hroute
 //	4. Eliminate .. elements that begin a rooted path:
 //	   that is, replace "/.." by "/" at the beginning of a path.
 //
-// If the result of this process is an empty string, "/" is returned
+// If the result of this process is an empty string, "/" is returned.
+// A trailing slash is preserved. If p is already clean, it is
+// returned unchanged without allocating.
 func CleanPath(p string) string {
 	// Turn empty string into "/"
 	if p == "" {
@@ -41,7 +43,7 @@ func CleanPath(p string) string {
 		buf[0] = '/'
 	}
 
-	trailing := n > 2 && p[n-1] == '/'
+	trailing := n > 1 && p[n-1] == '/'
 
 	// A bit more clunky without a 'lazybuf' like the path package, but the loop
 	// gets completely inlined (bufApp). So in contrast to the path package this
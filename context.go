@@ -0,0 +1,69 @@
+package hroute
+
+import (
+	"context"
+	"net/http"
+)
+
+// contextKey is the type of the keys used to store
+// routing information in request contexts.
+type contextKey int
+
+const (
+	paramsKey contextKey = iota
+	patternKey
+	optionsKey
+)
+
+// ParamsFromContext returns the parameters stored in the given
+// context by a Router with SetContext enabled or by HTTPHandler,
+// or nil if there are none.
+func ParamsFromContext(ctx context.Context) Params {
+	p, _ := ctx.Value(paramsKey).(Params)
+	return p
+}
+
+// MatchedPattern returns the pattern of the route matched by a Router
+// with SetContext enabled, or nil if there is none, for example because
+// the request is being served by the router's NotFound or MethodNotAllowed
+// handler or is being redirected. The pattern is available to any
+// middleware registered with Router.Use, which makes it suitable
+// for labelling metrics by route.
+func MatchedPattern(ctx context.Context) *Pattern {
+	pat, _ := ctx.Value(patternKey).(*Pattern)
+	return pat
+}
+
+// MatchedOptions returns the options of the route matched by a Router
+// with SetContext enabled. It returns the zero RouteOptions if there
+// are none.
+func MatchedOptions(ctx context.Context) RouteOptions {
+	if opts, _ := ctx.Value(optionsKey).(*RouteOptions); opts != nil {
+		return *opts
+	}
+	return RouteOptions{}
+}
+
+// HTTPHandler is an adaptor that allows an http.Handler to be
+// used as a Handler. It stores the parameters in the request
+// context, where they can be retrieved with ParamsFromContext.
+type HTTPHandler struct {
+	Handler http.Handler
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h HTTPHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	h.Handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), paramsKey, p)))
+}
+
+// withRouteContext returns a shallow copy of req with a context that
+// holds the given parameters and the pattern and options from the
+// given entry, which may be nil.
+func withRouteContext(req *http.Request, p Params, e *handlerEntry) *http.Request {
+	ctx := context.WithValue(req.Context(), paramsKey, p)
+	if e != nil {
+		ctx = context.WithValue(ctx, patternKey, e.pattern)
+		ctx = context.WithValue(ctx, optionsKey, &e.opts)
+	}
+	return req.WithContext(ctx)
+}
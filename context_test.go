@@ -0,0 +1,101 @@
+package hroute_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestSetContext(t *testing.T) {
+	var (
+		gotParams  hroute.Params
+		gotPattern *hroute.Pattern
+	)
+	downstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotParams = hroute.ParamsFromContext(req.Context())
+		gotPattern = hroute.MatchedPattern(req.Context())
+	})
+	r := hroute.New()
+	r.SetContext = true
+	r.HandleFunc("GET", "/users/:id", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		downstream.ServeHTTP(w, req)
+	})
+	r.NotFound = hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		downstream.ServeHTTP(w, req)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/users/42"))
+	if want := (hroute.Params{{"id", "42"}}); !reflect.DeepEqual(gotParams, want) {
+		t.Fatalf("unexpected params; got %#v want %#v", gotParams, want)
+	}
+	if gotPattern == nil {
+		t.Fatalf("no pattern found in context")
+	}
+	if got, want := gotPattern.String(), "/users/:id"; got != want {
+		t.Fatalf("unexpected pattern; got %q want %q", got, want)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/other"))
+	if gotPattern != nil {
+		t.Fatalf("unexpected pattern for not-found route: %q", gotPattern)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	var gotParams hroute.Params
+	r := hroute.New()
+	r.Handle("GET", "/users/:id/*path", hroute.HTTPHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotParams = hroute.ParamsFromContext(req.Context())
+		}),
+	})
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/users/42/a/b"))
+	expect := hroute.Params{{
+		Key:   "id",
+		Value: "42",
+	}, {
+		Key:   "path",
+		Value: "/a/b",
+	}}
+	if !reflect.DeepEqual(gotParams, expect) {
+		t.Errorf("unexpected params; got %#v want %#v", gotParams, expect)
+	}
+}
+
+func TestMatchedPatternInMiddleware(t *testing.T) {
+	r := hroute.New()
+	r.SetContext = true
+	var gotPattern *hroute.Pattern
+	r.Use(func(h hroute.Handler) hroute.Handler {
+		return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			gotPattern = hroute.MatchedPattern(req.Context())
+			h.ServeRoute(w, req, p)
+		})
+	})
+	r.HandleFunc("GET", "/users/:id", func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	r.HandleFunc("GET", "/dir/", func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	for _, test := range []struct {
+		method string
+		path   string
+		expect string
+	}{
+		{"GET", "/users/42", "/users/:id"},
+		{"GET", "/dir/", "/dir/"},
+		{"GET", "/dir", ""},
+		{"POST", "/users/42", ""},
+		{"GET", "/other", ""},
+	} {
+		gotPattern = nil
+		r.ServeHTTP(httptest.NewRecorder(), mustNewRequest(test.method, test.path))
+		got := ""
+		if gotPattern != nil {
+			got = gotPattern.String()
+		}
+		if got != test.expect {
+			t.Errorf("unexpected pattern for %s %s; got %q want %q", test.method, test.path, got, test.expect)
+		}
+	}
+}
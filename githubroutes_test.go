@@ -48,6 +48,47 @@ func TestGithubRoutes(t *testing.T) {
 	}
 }
 
+// newGithubBenchmark returns a router with all the GitHub API
+// routes registered and a request for each route.
+func newGithubBenchmark() (*hroute.Router, []*http.Request) {
+	r := hroute.New()
+	nop := hroute.HandlerFunc(func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	reqs := make([]*http.Request, len(githubAPI))
+	for i, p := range githubAPI {
+		method, path := methodAndPath(p)
+		r.Handle(method, path, nop)
+		reqs[i] = mustNewRequest(method, path)
+	}
+	return r, reqs
+}
+
+func BenchmarkGithubRoutes(b *testing.B) {
+	r, reqs := newGithubBenchmark()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(nil, reqs[i%len(reqs)])
+	}
+}
+
+// BenchmarkGithubRoutesParallel serves requests from many
+// goroutines at once. Lookups do not mutate any shared state,
+// so the time per operation should fall in proportion to the
+// number of CPUs (see the -cpu flag); if it does not, something
+// has introduced contention.
+func BenchmarkGithubRoutesParallel(b *testing.B) {
+	r, reqs := newGithubBenchmark()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.ServeHTTP(nil, reqs[i%len(reqs)])
+			i++
+		}
+	})
+}
+
 func paramsValues(ps hroute.Params) []string {
 	vs := make([]string, len(ps))
 	for i, p := range ps {
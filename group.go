@@ -0,0 +1,61 @@
+package hroute
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Group registers routes that share a common path prefix
+// and middleware. See Router.Group.
+type Group struct {
+	r          *Router
+	prefix     string
+	middleware []func(Handler) Handler
+}
+
+// Group returns a Group that registers routes on r with the given
+// prefix prepended to their patterns. For example,
+//
+//	r.Group("/api/v1").Handle("GET", "/users/:id", h)
+//
+// registers h for GET /api/v1/users/:id.
+func (r *Router) Group(prefix string) *Group {
+	return &Group{
+		r:      r,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+// Group returns a Group nested inside g, with the given prefix
+// appended to g's prefix. The nested group starts with the
+// middleware of g.
+func (g *Group) Group(prefix string) *Group {
+	return &Group{
+		r:          g.r,
+		prefix:     g.prefix + strings.TrimSuffix(prefix, "/"),
+		middleware: append([]func(Handler) Handler(nil), g.middleware...),
+	}
+}
+
+// Use adds middleware to be applied to the routes subsequently
+// registered with g, in the same way as WithMiddleware.
+func (g *Group) Use(mw ...func(Handler) Handler) {
+	g.middleware = append(g.middleware, mw...)
+}
+
+// Handle is like Router.Handle except that the group's prefix is
+// prepended to the pattern and the group's middleware is
+// applied to the route.
+func (g *Group) Handle(method, pattern string, handler Handler, opts ...RouteOption) *Pattern {
+	if len(g.middleware) > 0 {
+		opts = append([]RouteOption{WithMiddleware(g.middleware...)}, opts...)
+	}
+	return g.r.Handle(method, g.prefix+pattern, handler, opts...)
+}
+
+// HandleFunc is like Router.HandleFunc except that the group's prefix
+// is prepended to the pattern and the group's middleware is
+// applied to the route.
+func (g *Group) HandleFunc(method, pattern string, handler func(http.ResponseWriter, *http.Request, Params), opts ...RouteOption) *Pattern {
+	return g.Handle(method, pattern, HandlerFunc(handler), opts...)
+}
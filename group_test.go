@@ -0,0 +1,52 @@
+package hroute_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestGroup(t *testing.T) {
+	r := hroute.New()
+	var calls []string
+	mw := func(name string) func(hroute.Handler) hroute.Handler {
+		return func(h hroute.Handler) hroute.Handler {
+			return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+				calls = append(calls, name)
+				h.ServeRoute(w, req, p)
+			})
+		}
+	}
+	r.Use(mw("router"))
+	api := r.Group("/api/v1/")
+	api.Use(mw("api"))
+	users := api.Group("/users")
+	users.Use(mw("users"))
+	handler := func(name string) func(http.ResponseWriter, *http.Request, hroute.Params) {
+		return func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			calls = append(calls, name+" "+p.Get("id"))
+		}
+	}
+	api.HandleFunc("GET", "/status", handler("status"))
+	users.HandleFunc("GET", "/:id", handler("user"), hroute.WithMiddleware(mw("route")))
+
+	for _, test := range []struct {
+		path   string
+		expect []string
+	}{{
+		path:   "/api/v1/status",
+		expect: []string{"router", "api", "status "},
+	}, {
+		path:   "/api/v1/users/42",
+		expect: []string{"router", "api", "users", "route", "user 42"},
+	}} {
+		calls = nil
+		r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", test.path))
+		if !reflect.DeepEqual(calls, test.expect) {
+			t.Errorf("unexpected calls for %q; got %q want %q", test.path, calls, test.expect)
+		}
+	}
+}
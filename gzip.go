@@ -0,0 +1,112 @@
+package hroute
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// acceptsGzip reports whether the client that made
+// the request can accept a gzip-encoded response.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok && strings.Trim(q, "0.") == "" {
+			// q=0 means that gzip is explicitly not acceptable.
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// addVaryAcceptEncoding adds Accept-Encoding to the Vary header in h
+// unless it is already there, as it will be when a request has been
+// passed on from another gzipped route.
+func addVaryAcceptEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// gzipResponseWriter is an http.ResponseWriter that
+// compresses the response body with gzip.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+
+	// wroteHeader holds whether the header has been written.
+	wroteHeader bool
+
+	// encode holds whether the body is being compressed.
+	// Some responses, such as 204 No Content, have no body
+	// so are not compressed.
+	encode bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{
+		ResponseWriter: w,
+	}
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		w.encode = true
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *gzipResponseWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			// Sniff the content type from the uncompressed data
+			// because otherwise it would be sniffed from the
+			// compressed data.
+			w.Header().Set("Content-Type", http.DetectContentType(buf))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.encode {
+		return w.ResponseWriter.Write(buf)
+	}
+	return w.gz.Write(buf)
+}
+
+// Flush implements http.Flusher by flushing any
+// compressed data before flushing the underlying
+// ResponseWriter.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed response body.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
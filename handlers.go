@@ -1,7 +1,18 @@
 package hroute
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
 	"net/http"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 )
 
 // NotFound is used as the default hander when a route is not
@@ -13,6 +24,26 @@ func (h NotFound) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params)
 	http.NotFound(w, req)
 }
 
+// JSONNotFound can be used as a Router.NotFound handler by JSON APIs.
+// It responds with a StatusNotFound response holding a JSON object
+// that holds the method and path of the request, for example:
+//
+//	{"error":"not found","method":"GET","path":"/foo"}
+type JSONNotFound struct{}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h JSONNotFound) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	data, _ := json.Marshal(struct {
+		Error  string `json:"error"`
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}{"not found", req.Method, req.URL.Path})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(data)
+}
+
 // MethodNotAllowed is used as the default handler
 // when an implementation for a method is not found.
 type MethodNotAllowed struct{}
@@ -25,6 +56,67 @@ func (h MethodNotAllowed) ServeRoute(w http.ResponseWriter, req *http.Request, _
 	)
 }
 
+// MethodNotAllowedHandler may be implemented by a Router.MethodNotAllowed
+// handler that needs to know which methods are allowed for the
+// requested path, for example to write a custom error page.
+type MethodNotAllowedHandler interface {
+	Handler
+
+	// ServeMethodNotAllowed is called instead of ServeRoute with
+	// the sorted list of methods that are allowed for the path.
+	// The Allow header will already have been set.
+	ServeMethodNotAllowed(w http.ResponseWriter, req *http.Request, allowed []string)
+}
+
+// RequestURITooLong is used as the handler when the
+// request path is longer than the router allows.
+type RequestURITooLong struct{}
+
+// ServeRoute implements Handler.ServeRoute by returning a StatusRequestURITooLong response.
+func (h RequestURITooLong) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	http.Error(w,
+		http.StatusText(http.StatusRequestURITooLong),
+		http.StatusRequestURITooLong,
+	)
+}
+
+// RequestEntityTooLarge is used as the handler when the only
+// routes for the request's method have a maximum content length
+// that the request exceeds; see WithMaxContentLength.
+type RequestEntityTooLarge struct{}
+
+// ServeRoute implements Handler.ServeRoute by returning a StatusRequestEntityTooLarge response.
+func (h RequestEntityTooLarge) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	http.Error(w,
+		http.StatusText(http.StatusRequestEntityTooLarge),
+		http.StatusRequestEntityTooLarge,
+	)
+}
+
+// BadRequest is used as the handler when the
+// request path cannot be decoded; see Router.UseEncodedPath.
+type BadRequest struct{}
+
+// ServeRoute implements Handler.ServeRoute by returning a StatusBadRequest response.
+func (h BadRequest) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	http.Error(w,
+		http.StatusText(http.StatusBadRequest),
+		http.StatusBadRequest,
+	)
+}
+
+// Canceled is used as the handler when the request's context
+// has already been canceled; see Router.CheckContextCancel.
+type Canceled struct{}
+
+// ServeRoute implements Handler.ServeRoute by returning a StatusServiceUnavailable response.
+func (h Canceled) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	http.Error(w,
+		http.StatusText(http.StatusServiceUnavailable),
+		http.StatusServiceUnavailable,
+	)
+}
+
 // Redirect is used as the handler when the router requires a redirection.
 type Redirect struct {
 	Path string
@@ -44,3 +136,324 @@ type HandlerFunc func(http.ResponseWriter, *http.Request, Params)
 func (r HandlerFunc) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
 	r(w, req, p)
 }
+
+// RedirectToHTTPS returns a handler that redirects a request to the
+// same host and path using the https scheme, responding with the
+// given status code (usually http.StatusMovedPermanently or
+// http.StatusPermanentRedirect). A request that has already been made
+// over https, as indicated by req.TLS or the X-Forwarded-Proto header,
+// is treated as not found.
+func RedirectToHTTPS(code int) Handler {
+	return redirectToHTTPS(code)
+}
+
+type redirectToHTTPS int
+
+// ServeRoute implements Handler.ServeRoute.
+func (code redirectToHTTPS) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		http.NotFound(w, req)
+		return
+	}
+	u := *req.URL
+	u.Scheme = "https"
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	http.Redirect(w, req, u.String(), int(code))
+}
+
+// SPAHandler returns a handler suitable for serving a single-page
+// application from a catch-all route such as "/*path". It serves the
+// file named indexFile from fs for any path, so that routing can be
+// done by the client, except that a path whose final element has a
+// file extension (for example "/app.js") is treated as a missing static
+// asset and is not found.
+func SPAHandler(fs http.FileSystem, indexFile string) Handler {
+	return spaHandler{
+		fs:        fs,
+		indexFile: indexFile,
+	}
+}
+
+type spaHandler struct {
+	fs        http.FileSystem
+	indexFile string
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h spaHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	reqPath := req.URL.Path
+	if len(p) > 0 {
+		reqPath = p[len(p)-1].Value
+	}
+	if path.Ext(reqPath) != "" {
+		http.NotFound(w, req)
+		return
+	}
+	f, err := h.fs.Open(h.indexFile)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+}
+
+// FileServer returns a handler that serves files from root using
+// http.FileServer. It is intended to be registered on a catch-all route
+// such as "/static/*path": the value of the last parameter is used as
+// the path of the file to serve.
+//
+// If the file does not exist or the path contains a ".." element,
+// the handler passes (see ErrPass), so the request is served by the
+// next-best matching route or by the router's NotFound handler,
+// which will see the status http.StatusNotFound if Router.ErrorHandler
+// is set.
+func FileServer(root http.FileSystem) Handler {
+	return fileServer{
+		fs: root,
+		h:  http.FileServer(root),
+	}
+}
+
+// SingleRoute returns an http.Handler that serves requests whose URL
+// path matches the given pattern by calling h.ServeRoute with the
+// parameters from the path, and responds with a 404 status to all
+// other requests. It is useful for serving a single route from
+// code that uses another multiplexer, such as http.ServeMux.
+// The path is matched as by Pattern.Matches.
+func SingleRoute(pattern string, h Handler) (http.Handler, error) {
+	pat, err := ParsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return singleRoute{
+		pat:  pat,
+		root: pat.tree(),
+		h:    h,
+	}, nil
+}
+
+type singleRoute struct {
+	pat  *Pattern
+	root *node
+	h    Handler
+}
+
+// ServeHTTP implements http.Handler.
+func (h singleRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p, ok := h.pat.match(h.root, req.URL.Path)
+	if !ok {
+		NotFound{}.ServeRoute(w, req, Params{})
+		return
+	}
+	h.h.ServeRoute(w, req, p)
+}
+
+type fileServer struct {
+	fs http.FileSystem
+	h  http.Handler
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h fileServer) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	filePath := "/"
+	if len(p) > 0 {
+		filePath = p[len(p)-1].Value
+	}
+	if !strings.HasPrefix(filePath, "/") {
+		filePath = "/" + filePath
+	}
+	if containsDotDot(filePath) || !h.exists(filePath) {
+		panic(ErrPass)
+	}
+	req1 := *req
+	u := *req.URL
+	u.Path = filePath
+	u.RawPath = ""
+	req1.URL = &u
+	h.h.ServeHTTP(w, &req1)
+}
+
+// exists reports whether the file with the given path exists.
+// Other errors, such as permission errors, are left for
+// http.FileServer to report.
+func (h fileServer) exists(filePath string) bool {
+	f, err := h.fs.Open(filePath)
+	if err != nil {
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+	f.Close()
+	return true
+}
+
+// containsDotDot reports whether any slash-separated element
+// of p is "..".
+func containsDotDot(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoverHandler can be used as the value of Router.Panic. It logs the
+// recovered value along with a stack trace and responds with
+// StatusInternalServerError, unless the handler that panicked has
+// already written the response header, in which case the response
+// is left as is.
+func RecoverHandler(w http.ResponseWriter, req *http.Request, h Handler, p Params, err interface{}) {
+	log.Printf("hroute: panic serving %s %s: %v\n%s", req.Method, req.URL.Path, err, debug.Stack())
+	if pw, ok := w.(*panicResponseWriter); ok && pw.wroteHeader {
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// panicResponseWriter is used when Router.Panic is set
+// to record whether the response header has been written.
+type panicResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *panicResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *panicResponseWriter) Write(buf []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush implements http.Flusher when the underlying
+// ResponseWriter does.
+func (w *panicResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter
+// for the benefit of http.ResponseController.
+func (w *panicResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TimeoutHandler returns a handler that runs h with a request context
+// that is canceled after the duration d. If h has not returned by
+// then, the client is sent a StatusServiceUnavailable response, and
+// any later writes by h to its http.ResponseWriter fail with
+// http.ErrHandlerTimeout. Like http.TimeoutHandler, it buffers the
+// response written by h until h returns, so h cannot use the
+// http.Flusher or http.Hijacker interfaces.
+//
+// Because h may still be running after TimeoutHandler's ServeRoute
+// method has returned, h is passed a copy of the parameters.
+// See also WithTimeout, which records a timeout for middleware
+// to act on.
+func TimeoutHandler(d time.Duration, h Handler) Handler {
+	return timeoutHandler{
+		d: d,
+		h: h,
+	}
+}
+
+type timeoutHandler struct {
+	d time.Duration
+	h Handler
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h timeoutHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	ctx, cancel := context.WithTimeout(req.Context(), h.d)
+	defer cancel()
+	req = req.WithContext(ctx)
+	p = append(Params(nil), p...)
+	tw := &timeoutWriter{
+		h: make(http.Header),
+	}
+	done := make(chan struct{})
+	panicc := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if rcv := recover(); rcv != nil {
+				panicc <- rcv
+			}
+		}()
+		h.h.ServeRoute(tw, req, p)
+		close(done)
+	}()
+	select {
+	case rcv := <-panicc:
+		panic(rcv)
+	case <-done:
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		dst := w.Header()
+		for k, v := range tw.h {
+			dst[k] = v
+		}
+		if tw.code == 0 {
+			tw.code = http.StatusOK
+		}
+		w.WriteHeader(tw.code)
+		w.Write(tw.buf.Bytes())
+	case <-ctx.Done():
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		tw.timedOut = true
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+}
+
+// timeoutWriter is the http.ResponseWriter passed to the
+// handler by timeoutHandler. It buffers the response until
+// the handler returns.
+type timeoutWriter struct {
+	h http.Header
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+// Header implements http.ResponseWriter.Header.
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+// Write implements http.ResponseWriter.Write.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
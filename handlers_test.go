@@ -0,0 +1,356 @@
+package hroute_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	h := hroute.RedirectToHTTPS(http.StatusPermanentRedirect)
+	req := mustNewRequest("GET", "http://example.com/foo/bar?x=1")
+	w := httptest.NewRecorder()
+	h.ServeRoute(w, req, nil)
+	if got, want := w.Code, http.StatusPermanentRedirect; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := w.Header().Get("Location"), "https://example.com/foo/bar?x=1"; got != want {
+		t.Fatalf("unexpected location; got %q want %q", got, want)
+	}
+
+	req = mustNewRequest("GET", "http://example.com/foo")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	h.ServeRoute(w, req, nil)
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status for https request; got %d want %d", got, want)
+	}
+}
+
+func TestJSONNotFound(t *testing.T) {
+	r := hroute.New()
+	r.NotFound = hroute.JSONNotFound{}
+	r.HandleFunc("GET", "/a/b", func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	for _, path := range []string{"/x", "/a/c"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, mustNewRequest("GET", path))
+		if got, want := w.Code, http.StatusNotFound; got != want {
+			t.Fatalf("%s: unexpected status; got %d want %d", path, got, want)
+		}
+		if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+			t.Fatalf("%s: unexpected content type; got %q want %q", path, got, want)
+		}
+		if got, want := w.Body.String(), `{"error":"not found","method":"GET","path":"`+path+`"}`; got != want {
+			t.Fatalf("%s: unexpected body; got %q want %q", path, got, want)
+		}
+	}
+
+	// A nil NotFound handler behaves like NotFound{}.
+	r.NotFound = nil
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/x"))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status with nil NotFound; got %d want %d", got, want)
+	}
+}
+
+func TestSPAHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>spa</html>"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := hroute.New()
+	r.Handle("GET", "/*path", hroute.SPAHandler(http.Dir(dir), "index.html"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/dashboard"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := w.Body.String(), "<html>spa</html>"; got != want {
+		t.Fatalf("unexpected body; got %q want %q", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/missing.js"))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status for missing asset; got %d want %d", got, want)
+	}
+}
+
+func TestHandlePrefixStrip(t *testing.T) {
+	var innerPath string
+	inner := http.NewServeMux()
+	inner.HandleFunc("/cmdline", func(w http.ResponseWriter, req *http.Request) {
+		innerPath = req.URL.Path
+		pprof.Cmdline(w, req)
+	})
+	r := hroute.New()
+	r.HandlePrefixStrip("/debug/pprof/", inner)
+
+	w := httptest.NewRecorder()
+	req := mustNewRequest("GET", "/debug/pprof/cmdline")
+	r.ServeHTTP(w, req)
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := innerPath, "/cmdline"; got != want {
+		t.Fatalf("unexpected inner path; got %q want %q", got, want)
+	}
+	if got, want := req.URL.Path, "/debug/pprof/cmdline"; got != want {
+		t.Fatalf("original request changed; got %q want %q", got, want)
+	}
+}
+
+func TestPprofIndex(t *testing.T) {
+	// pprof.Index relies on the full path, so it is
+	// registered without stripping the prefix.
+	r := hroute.New()
+	r.HandleFunc("GET", "/debug/pprof/*name", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		pprof.Index(w, req)
+	})
+	for _, test := range []struct {
+		path   string
+		expect string
+	}{
+		{"/debug/pprof/", "Types of profiles available"},
+		{"/debug/pprof/heap?debug=1", "heap profile:"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, mustNewRequest("GET", test.path))
+		if got, want := w.Code, http.StatusOK; got != want {
+			t.Fatalf("unexpected status for %q; got %d want %d", test.path, got, want)
+		}
+		if !strings.Contains(w.Body.String(), test.expect) {
+			t.Errorf("unexpected body for %q; got %.100q want text containing %q", test.path, w.Body.String(), test.expect)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	var gotPath string
+	var gotParams hroute.Params
+	api := hroute.New()
+	api.HandleFunc("GET", "/users/:id", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		gotPath, gotParams = req.URL.Path, p
+	})
+	api.HandleFunc("GET", "/", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		gotPath, gotParams = req.URL.Path, p
+	})
+	api.HandleFunc("GET", "/files/*file", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		gotPath, gotParams = req.URL.Path, p
+	})
+	r := hroute.New()
+	r.Handle("*", "/api/*path", hroute.StripPrefix("/api/", api))
+	r.Handle("*", "/other/*path", hroute.StripPrefix("/api", api))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/api/users/42"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := gotPath, "/users/42"; got != want {
+		t.Fatalf("unexpected path; got %q want %q", got, want)
+	}
+	// The outer route's parameters come first.
+	if want := (hroute.Params{{"path", "/users/42"}, {"id", "42"}}); !reflect.DeepEqual(gotParams, want) {
+		t.Fatalf("unexpected params; got %#v want %#v", gotParams, want)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/api/"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status for root; got %d want %d", got, want)
+	}
+	if got, want := gotPath, "/"; got != want {
+		t.Fatalf("unexpected path for root; got %q want %q", got, want)
+	}
+
+	// The inner route's catch-all parameter stays last.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/api/files/a/b"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status for files; got %d want %d", got, want)
+	}
+	if want := (hroute.Params{{"path", "/files/a/b"}, {"file", "/a/b"}}); !reflect.DeepEqual(gotParams, want) {
+		t.Fatalf("unexpected params for files; got %#v want %#v", gotParams, want)
+	}
+
+	// A path that does not carry the prefix is not found.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/other/users/42"))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status without prefix; got %d want %d", got, want)
+	}
+}
+
+func TestFileServer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "css"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "css", "site.css"), []byte("body{}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := hroute.New()
+	r.Handle("GET", "/static/*path", hroute.FileServer(http.Dir(dir)))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/static/css/site.css"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := w.Body.String(), "body{}"; got != want {
+		t.Fatalf("unexpected body; got %q want %q", got, want)
+	}
+
+	// Missing files are served by the router's NotFound handler.
+	r.NotFound = hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		http.Error(w, "custom not found", http.StatusNotFound)
+	})
+	r.RedirectCleanPath = false
+	for _, path := range []string{
+		"/static/css/missing.css",
+		"/static/css/../css/site.css",
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, mustNewRequest("GET", path))
+		if got, want := w.Code, http.StatusNotFound; got != want {
+			t.Fatalf("unexpected status for %q; got %d want %d", path, got, want)
+		}
+		if got, want := w.Body.String(), "custom not found\n"; got != want {
+			t.Fatalf("unexpected body for %q; got %q want %q", path, got, want)
+		}
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	r := hroute.New()
+	r.Panic = hroute.RecoverHandler
+	r.HandleFunc("GET", "/boom", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		panic("boom")
+	})
+	r.HandleFunc("GET", "/late", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/boom"))
+	if got, want := w.Code, http.StatusInternalServerError; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if !strings.Contains(logBuf.String(), "hroute: panic serving GET /boom: boom") {
+		t.Fatalf("panic not logged; got %q", logBuf.String())
+	}
+
+	// When the header has already been written, it is left alone.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/late"))
+	if got, want := w.Code, http.StatusAccepted; got != want {
+		t.Fatalf("unexpected status after header written; got %d want %d", got, want)
+	}
+	if got := w.Body.String(); got != "" {
+		t.Fatalf("unexpected body after header written; got %q", got)
+	}
+}
+
+func TestSingleRoute(t *testing.T) {
+	h, err := hroute.SingleRoute("/users/:id", hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		w.Write([]byte("user " + p.Get("id")))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/users/", h)
+	for _, test := range []struct {
+		path       string
+		expectCode int
+		expectBody string
+	}{
+		{"/users/42", http.StatusOK, "user 42"},
+		{"/users/42/x", http.StatusNotFound, "404 page not found\n"},
+		{"/users/", http.StatusNotFound, "404 page not found\n"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.expectCode || rec.Body.String() != test.expectBody {
+			t.Errorf("%s: unexpected response; got %d %q want %d %q", test.path, rec.Code, rec.Body.String(), test.expectCode, test.expectBody)
+		}
+	}
+
+	if _, err := hroute.SingleRoute("no-slash", nil); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	fast := hroute.TimeoutHandler(time.Minute, hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		if _, ok := req.Context().Deadline(); !ok {
+			t.Errorf("no deadline on request context")
+		}
+		w.Header().Set("X-Id", p.Get("id"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	rec := httptest.NewRecorder()
+	fast.ServeRoute(rec, httptest.NewRequest("GET", "/", nil), hroute.Params{{"id", "42"}})
+	if rec.Code != http.StatusCreated || rec.Body.String() != "created" || rec.Header().Get("X-Id") != "42" {
+		t.Errorf("unexpected response from fast handler; got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	release := make(chan struct{})
+	writeErr := make(chan error, 1)
+	slow := hroute.TimeoutHandler(time.Millisecond, hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		<-release
+		_, err := w.Write([]byte("too late"))
+		writeErr <- err
+	}))
+	rec = httptest.NewRecorder()
+	slow.ServeRoute(rec, httptest.NewRequest("GET", "/", nil), nil)
+	close(release)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status from slow handler; got %d want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if err := <-writeErr; err != http.ErrHandlerTimeout {
+		t.Errorf("unexpected error from write after timeout; got %v want %v", err, http.ErrHandlerTimeout)
+	}
+	if strings.Contains(rec.Body.String(), "too late") {
+		t.Errorf("write after timeout reached the response: %q", rec.Body.String())
+	}
+}
+
+func TestHandlePrefixStripSubroute(t *testing.T) {
+	var innerPath string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		innerPath = req.URL.Path
+	})
+	sub := hroute.New()
+	sub.HandlePrefixStrip("/pprof/", inner)
+	r := hroute.New()
+	r.Handle("*", "/debug/*rest", sub)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/debug/pprof/cmdline"))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := innerPath, "/cmdline"; got != want {
+		t.Fatalf("unexpected inner path; got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package hroute
+
+import (
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// HostRouter registers routes that are specific to a host.
+// See Router.Host.
+type HostRouter struct {
+	r    *Router
+	root *node
+}
+
+// Host returns a HostRouter that registers routes that are only
+// served for requests with the given host name, as found in
+// req.Host with any port removed. The host name is matched without
+// regard to case. When ServeHTTP is called for such a request, the
+// routes registered for the host are consulted first; if none of them
+// match, the request is routed as if it had no host-specific routes.
+//
+// Host-specific routes are not taken into account by HandlerToUse,
+// Lookup or Explain, which do not have a request to consult.
+func (r *Router) Host(host string) *HostRouter {
+	host = strings.ToLower(host)
+	root := r.hosts[host]
+	if root == nil {
+		if r.frozen {
+			panic(errgo.Newf("cannot add host %q to frozen router", host))
+		}
+		if r.hosts == nil {
+			r.hosts = make(map[string]*node)
+		}
+		root = &node{
+			path: "/",
+		}
+		r.hosts[host] = root
+	}
+	return &HostRouter{
+		r:    r,
+		root: root,
+	}
+}
+
+// Handle is like Router.Handle except that the route is
+// only served for the host.
+func (h *HostRouter) Handle(method, pattern string, handler Handler, opts ...RouteOption) *Pattern {
+	pat, err := h.r.handle(h.root, []string{method}, pattern, handlerEntry{handler: handler}, opts)
+	if err != nil {
+		panic(err)
+	}
+	return pat
+}
+
+// HandleFunc is like Router.HandleFunc except that the route is
+// only served for the host.
+func (h *HostRouter) HandleFunc(method, pattern string, handler func(http.ResponseWriter, *http.Request, Params), opts ...RouteOption) *Pattern {
+	return h.Handle(method, pattern, HandlerFunc(handler), opts...)
+}
+
+// hostName returns the host name from the given
+// request host, without any port and in lower case.
+func hostName(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,72 @@
+package hroute_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+var hostTests = []struct {
+	host   string
+	path   string
+	expect string
+}{{
+	host:   "api.example.com",
+	path:   "/v1/users",
+	expect: "api users",
+}, {
+	host:   "API.example.com:8080",
+	path:   "/v1/users",
+	expect: "api users",
+}, {
+	host:   "www.example.com",
+	path:   "/v1/users",
+	expect: "default users",
+}, {
+	host:   "api.example.com",
+	path:   "/healthz",
+	expect: "default healthz",
+}, {
+	host:   "other.example.com",
+	path:   "/v1/users",
+	expect: "default users",
+}}
+
+func TestHost(t *testing.T) {
+	r := hroute.New()
+	var served string
+	handler := func(name string) hroute.Handler {
+		return hroute.HandlerFunc(func(http.ResponseWriter, *http.Request, hroute.Params) {
+			served = name
+		})
+	}
+	r.Host("api.example.com").Handle("GET", "/v1/users", handler("api users"))
+	r.Host("www.example.com").Handle("GET", "/index.html", handler("www index"))
+	r.Handle("GET", "/v1/users", handler("default users"))
+	r.Handle("GET", "/healthz", handler("default healthz"))
+	for _, test := range hostTests {
+		served = ""
+		req := mustNewRequest("GET", test.path)
+		req.Host = test.host
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		if served != test.expect {
+			t.Errorf("unexpected handler for %s%s; got %q want %q", test.host, test.path, served, test.expect)
+		}
+	}
+	var routes []string
+	for _, route := range r.Routes() {
+		routes = append(routes, route.Host+" "+route.Pattern.String())
+	}
+	expect := []string{
+		" /healthz",
+		" /v1/users",
+		"api.example.com /v1/users",
+		"www.example.com /index.html",
+	}
+	if !reflect.DeepEqual(routes, expect) {
+		t.Errorf("unexpected routes; got %q want %q", routes, expect)
+	}
+}
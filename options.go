@@ -0,0 +1,168 @@
+package hroute
+
+import (
+	"net/http"
+	"time"
+)
+
+// RouteOption represents an option that can be passed to Router.Handle
+// to change the behaviour of a single route.
+type RouteOption func(*RouteOptions)
+
+// RouteOptions holds the options that have been
+// applied to a route.
+type RouteOptions struct {
+	// PreHandler holds the function set by WithPreHandler.
+	PreHandler func(http.ResponseWriter, *http.Request, Params) bool
+
+	// MaxContentLength holds the maximum content length
+	// of a request matched by the route, as set by
+	// WithMaxContentLength. It is only used if
+	// LimitContentLength is true.
+	MaxContentLength   int64
+	LimitContentLength bool
+
+	// Gzip holds whether responses should be compressed
+	// when the client accepts it, as set by WithGzip.
+	Gzip bool
+
+	// StrictSlash holds whether the router should not redirect
+	// to the route from a path that differs only in its trailing
+	// slash, as set by WithStrictSlash.
+	StrictSlash bool
+
+	// Timeout holds the timeout set by WithTimeout.
+	Timeout time.Duration
+
+	// Values holds the values set by WithValue.
+	Values map[interface{}]interface{}
+
+	// Name holds the name of the route set by WithName.
+	Name string
+
+	// Middleware holds the middleware set by WithMiddleware,
+	// outermost first.
+	Middleware []func(Handler) Handler
+}
+
+// Value returns the value associated with the given key
+// by WithValue, or nil if there is none.
+func (o *RouteOptions) Value(key interface{}) interface{} {
+	return o.Values[key]
+}
+
+// constrained reports whether the options restrict
+// the requests that the route will match.
+func (o *RouteOptions) constrained() bool {
+	return o.LimitContentLength
+}
+
+// matchRequest reports whether a route with the options
+// can serve the given request.
+func (o *RouteOptions) matchRequest(req *http.Request) bool {
+	if o.LimitContentLength && (req.ContentLength < 0 || req.ContentLength > o.MaxContentLength) {
+		return false
+	}
+	return true
+}
+
+// covers reports whether every request that a route with
+// options o1 can serve can also be served by a route with
+// options o.
+func (o *RouteOptions) covers(o1 *RouteOptions) bool {
+	if !o.LimitContentLength {
+		return true
+	}
+	return o1.LimitContentLength && o1.MaxContentLength <= o.MaxContentLength
+}
+
+// WithPreHandler returns a RouteOption that causes f to be called
+// with the route's parameters before the route's handler is invoked.
+// If f returns false, the handler is not called; f is then responsible
+// for writing the response. This can be used, for example, to
+// validate parameters specific to a route.
+func WithPreHandler(f func(w http.ResponseWriter, req *http.Request, p Params) bool) RouteOption {
+	return func(o *RouteOptions) {
+		o.PreHandler = f
+	}
+}
+
+// WithMaxContentLength returns a RouteOption that causes the route
+// to match only requests with a known content length of at most n
+// bytes. A route with this option may be registered for the same
+// pattern and method as a route without it, which will then be used
+// for larger requests and for requests with an unknown content length.
+// If there are several such routes, the one with the smallest limit
+// that the request fits within is used. If no route for the method
+// can serve the request, the router responds with
+// RequestEntityTooLarge rather than MethodNotAllowed.
+func WithMaxContentLength(n int64) RouteOption {
+	return func(o *RouteOptions) {
+		o.MaxContentLength = n
+		o.LimitContentLength = true
+	}
+}
+
+// WithGzip returns a RouteOption that causes responses from the route
+// to be compressed with gzip when the client accepts gzip encoding.
+// See also Router.Gzip.
+func WithGzip() RouteOption {
+	return func(o *RouteOptions) {
+		o.Gzip = true
+	}
+}
+
+// WithStrictSlash returns a RouteOption that controls whether the
+// trailing slash of the route is significant. When strict is true, a
+// request for a path that matches the route except for an added or
+// removed trailing slash is not found rather than being redirected to
+// the route. Use this when, for example, "/x" and "/x/" are different
+// resources.
+func WithStrictSlash(strict bool) RouteOption {
+	return func(o *RouteOptions) {
+		o.StrictSlash = strict
+	}
+}
+
+// WithTimeout returns a RouteOption that records a timeout for the
+// route. The router does not enforce the timeout itself; it is there
+// for middleware to act on, having obtained it from Router.Lookup or
+// MatchedOptions.
+func WithTimeout(d time.Duration) RouteOption {
+	return func(o *RouteOptions) {
+		o.Timeout = d
+	}
+}
+
+// WithValue returns a RouteOption that associates the given value with
+// the given key in the route's options. This can be used to attach
+// arbitrary metadata, such as authorization requirements, to a route
+// for middleware to act on.
+func WithValue(key, val interface{}) RouteOption {
+	return func(o *RouteOptions) {
+		if o.Values == nil {
+			o.Values = make(map[interface{}]interface{})
+		}
+		o.Values[key] = val
+	}
+}
+
+// WithName returns a RouteOption that names the route so that its path
+// can be constructed with Router.URL. Router.Handle panics if a route
+// with the same name has already been registered.
+func WithName(name string) RouteOption {
+	return func(o *RouteOptions) {
+		o.Name = name
+	}
+}
+
+// WithMiddleware returns a RouteOption that applies the given
+// middleware to the route's handler when it serves a request. The
+// middleware is applied inside any middleware registered with
+// Router.Use, and middleware given earlier wraps middleware given
+// later.
+func WithMiddleware(mw ...func(Handler) Handler) RouteOption {
+	return func(o *RouteOptions) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
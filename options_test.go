@@ -0,0 +1,334 @@
+package hroute_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestWithPreHandler(t *testing.T) {
+	r := hroute.New()
+	called := false
+	r.HandleFunc("GET", "/item/:id", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		called = true
+	}, hroute.WithPreHandler(func(w http.ResponseWriter, req *http.Request, p hroute.Params) bool {
+		if p.Get("id") != "ok" {
+			http.Error(w, "bad id", http.StatusUnprocessableEntity)
+			return false
+		}
+		return true
+	}))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/item/bad"))
+	if called {
+		t.Fatalf("handler called despite failed validation")
+	}
+	if got, want := w.Code, http.StatusUnprocessableEntity; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/item/ok"))
+	if !called {
+		t.Fatalf("handler not called after successful validation")
+	}
+}
+
+func TestWithMaxContentLength(t *testing.T) {
+	r := hroute.New()
+	var called string
+	r.HandleFunc("POST", "/upload", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		called = "sync"
+	}, hroute.WithMaxContentLength(10))
+	r.HandleFunc("POST", "/upload", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		called = "stream"
+	})
+	for _, test := range []struct {
+		body   string
+		expect string
+	}{
+		{"small", "sync"},
+		{"0123456789", "sync"},
+		{"a much larger body", "stream"},
+	} {
+		called = ""
+		req, err := http.NewRequest("POST", "/upload", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		if called != test.expect {
+			t.Errorf("unexpected handler for body %q; got %q want %q", test.body, called, test.expect)
+		}
+	}
+}
+
+func TestWithMaxContentLengthOrder(t *testing.T) {
+	r := hroute.New()
+	var called string
+	handler := func(name string) hroute.HandlerFunc {
+		return func(http.ResponseWriter, *http.Request, hroute.Params) {
+			called = name
+		}
+	}
+	// The tighter limit is registered last but is still used
+	// for the smallest requests.
+	r.Handle("POST", "/upload", handler("medium"), hroute.WithMaxContentLength(100))
+	r.Handle("POST", "/upload", handler("small"), hroute.WithMaxContentLength(10))
+	r.Handle("GET", "/upload", handler("get"))
+	for _, test := range []struct {
+		size       int64
+		expect     string
+		expectCode int
+	}{
+		{5, "small", http.StatusOK},
+		{50, "medium", http.StatusOK},
+		{500, "", http.StatusRequestEntityTooLarge},
+		{-1, "", http.StatusRequestEntityTooLarge},
+	} {
+		called = ""
+		req := mustNewRequest("POST", "/upload")
+		req.ContentLength = test.size
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if called != test.expect {
+			t.Errorf("unexpected handler for size %d; got %q want %q", test.size, called, test.expect)
+		}
+		if w.Code != test.expectCode {
+			t.Errorf("unexpected status for size %d; got %d want %d", test.size, w.Code, test.expectCode)
+		}
+		if allow := w.Header().Get("Allow"); allow != "" {
+			t.Errorf("unexpected Allow header for size %d: %q", test.size, allow)
+		}
+	}
+	// Other methods are still not allowed.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("PUT", "/upload"))
+	if got, want := w.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("unexpected status for PUT; got %d want %d", got, want)
+	}
+	if got, want := w.Header().Get("Allow"), "GET, POST"; got != want {
+		t.Errorf("unexpected Allow header for PUT; got %q want %q", got, want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	r := hroute.New()
+	r.Handle("POST", "/upload/:name", nopHandler("upload"),
+		hroute.WithMaxContentLength(1024),
+		hroute.WithPreHandler(func(http.ResponseWriter, *http.Request, hroute.Params) bool {
+			return true
+		}),
+	)
+	e := r.Explain("POST", "/upload/foo")
+	if e.Handler != hroute.Handler(nopHandler("upload")) {
+		t.Fatalf("unexpected handler %#v", e.Handler)
+	}
+	if e.Pattern == nil || e.Pattern.String() != "/upload/:name" {
+		t.Fatalf("unexpected pattern %v", e.Pattern)
+	}
+	if got := e.Params.Get("name"); got != "foo" {
+		t.Fatalf("unexpected name parameter %q", got)
+	}
+	if !e.Options.LimitContentLength || e.Options.MaxContentLength != 1024 {
+		t.Fatalf("unexpected content length options: %#v", e.Options)
+	}
+	if e.Options.PreHandler == nil {
+		t.Fatalf("no pre-handler found in options")
+	}
+
+	e = r.Explain("GET", "/upload/foo")
+	if e.Handler != hroute.Handler(hroute.MethodNotAllowed{}) || e.Pattern != nil {
+		t.Fatalf("unexpected explanation for GET: %#v", e)
+	}
+}
+
+func TestWithGzip(t *testing.T) {
+	const body = "hello, hello, hello, hello, hello"
+	r := hroute.New()
+	r.HandleFunc("GET", "/z", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		w.Write([]byte(body))
+	}, hroute.WithGzip())
+
+	req := mustNewRequest("GET", "/z")
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got, want := w.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("unexpected content encoding; got %q want %q", got, want)
+	}
+	if got, want := w.Header().Get("Vary"), "Accept-Encoding"; got != want {
+		t.Fatalf("unexpected Vary header; got %q want %q", got, want)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Fatalf("unexpected content type; got %q want %q", got, want)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("cannot read gzip body: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("cannot decompress body: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("unexpected body; got %q want %q", data, body)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/z"))
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("unexpected content encoding %q", got)
+	}
+	if got := w.Body.String(); got != body {
+		t.Fatalf("unexpected body; got %q want %q", got, body)
+	}
+
+	req = mustNewRequest("GET", "/z")
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("unexpected content encoding %q with q=0", got)
+	}
+}
+
+func TestWithGzipPass(t *testing.T) {
+	const body = "hello, hello, hello, hello, hello"
+	r := hroute.New()
+	r.HandleFunc("GET", "/:id(\\d+)", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		panic(hroute.ErrPass)
+	}, hroute.WithGzip())
+	r.HandleFunc("GET", "/:id", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		w.Write([]byte(body))
+	}, hroute.WithGzip())
+
+	req := mustNewRequest("GET", "/1")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got, want := w.Header().Values("Vary"), []string{"Accept-Encoding"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected Vary header; got %q want %q", got, want)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("cannot read gzip body: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("cannot decompress body: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("unexpected body; got %q want %q", data, body)
+	}
+}
+
+type authKey struct{}
+
+func TestRouteOptionsAccess(t *testing.T) {
+	r := hroute.New()
+	r.SetContext = true
+	var ctxOpts hroute.RouteOptions
+	r.HandleFunc("GET", "/admin", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		ctxOpts = hroute.MatchedOptions(req.Context())
+	}, hroute.WithTimeout(5*time.Second), hroute.WithValue(authKey{}, "admin"))
+
+	res := r.Lookup("GET", "/admin")
+	checkOpts := func(opts hroute.RouteOptions) {
+		if got, want := opts.Timeout, 5*time.Second; got != want {
+			t.Errorf("unexpected timeout; got %v want %v", got, want)
+		}
+		if got, want := opts.Value(authKey{}), "admin"; got != want {
+			t.Errorf("unexpected auth value; got %#v want %#v", got, want)
+		}
+	}
+	checkOpts(res.Options)
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/admin"))
+	checkOpts(ctxOpts)
+}
+
+func TestWithStrictSlash(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/file", nopHandler("file"), hroute.WithStrictSlash(true))
+	r.Handle("GET", "/dir/", nopHandler("dir"))
+	for _, test := range []struct {
+		path   string
+		expect hroute.Handler
+	}{
+		{"/file", nopHandler("file")},
+		{"/file/", hroute.NotFound{}},
+		{"/dir/", nopHandler("dir")},
+		{"/dir", hroute.Redirect{Path: "/dir/", Code: http.StatusMovedPermanently}},
+	} {
+		if h, _, _ := r.HandlerToUse("GET", test.path); h != test.expect {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", test.path, h, test.expect)
+		}
+	}
+
+	// The case-insensitive lookup must not add or remove
+	// the slash either, although it may still fix the case.
+	r.RedirectFixedPath = true
+	for _, test := range []struct {
+		path   string
+		expect hroute.Handler
+	}{
+		{"/file/", hroute.NotFound{}},
+		{"/FILE/", hroute.NotFound{}},
+		{"/FILE", hroute.Redirect{Path: "/file", Code: http.StatusMovedPermanently}},
+		{"/DIR", hroute.Redirect{Path: "/dir/", Code: http.StatusMovedPermanently}},
+	} {
+		if h, _, _ := r.HandlerToUse("GET", test.path); h != test.expect {
+			t.Errorf("unexpected handler for %q with RedirectFixedPath; got %#v want %#v", test.path, h, test.expect)
+		}
+	}
+}
+
+func TestWithName(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/users/:id/profile", nopHandler("profile"), hroute.WithName("user.profile"))
+	r.Handle("GET", "/files/*path", nopHandler("files"), hroute.WithName("files"))
+
+	path, err := r.URL("user.profile", "id", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/users/42/profile"; path != want {
+		t.Errorf("unexpected path; got %q want %q", path, want)
+	}
+	path, err = r.URL("files", "path", "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/files/a/b"; path != want {
+		t.Errorf("unexpected path; got %q want %q", path, want)
+	}
+	if _, err := r.URL("user.profile"); err == nil || err.Error() != `no value for parameter "id"` {
+		t.Errorf("unexpected error for missing parameter: %v", err)
+	}
+	if _, err := r.URL("other"); err == nil || err.Error() != `no route found with name "other"` {
+		t.Errorf("unexpected error for unknown name: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if got, want := fmt.Sprint(recover()), `duplicate route name "files"`; got != want {
+				t.Errorf("unexpected panic; got %q want %q", got, want)
+			}
+		}()
+		r.Handle("GET", "/other", nopHandler("other"), hroute.WithName("files"))
+	}()
+
+	r.Remove("GET", "/files/*path")
+	if _, err := r.URL("files", "path", "/a"); err == nil {
+		t.Errorf("expected error for name of removed route")
+	}
+}
@@ -1,7 +1,9 @@
 package hroute
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"gopkg.in/errgo.v1"
@@ -9,10 +11,46 @@ import (
 
 // Pattern holds a parsed path pattern.
 type Pattern struct {
-	static     []string
-	vars       []string
+	static []string
+	vars   []string
+
+	// multi records which variables match multiple path
+	// segments. It is indexed like vars but may be shorter
+	// than vars or nil; missing elements are false.
+	multi []bool
+
+	// constraints holds any regular expressions that constrain
+	// the values of single-segment variables. It is indexed like
+	// vars but may be shorter than vars or nil; missing elements
+	// are nil.
+	constraints []*constraint
+
 	catchAll   bool
 	staticSize int // sum(len(static[i]))
+
+	// optionalSlash records whether the pattern ended in "{/}",
+	// so that it also matches paths with a trailing slash.
+	optionalSlash bool
+
+	// optional records whether the last variable is an
+	// optional :name? wildcard, so that the pattern also
+	// matches paths without the final segment.
+	optional bool
+
+	// sep holds the segment separator used by the router that
+	// the pattern was registered with, or zero if it is '/'.
+	// The pattern itself is always held with '/' as the separator;
+	// see swapSeparator.
+	sep byte
+
+	// catchAllNoSlash records that the pattern was registered with
+	// a router with CatchAllNoLeadingSlash set, so that catch-all
+	// values do not start with the separator.
+	catchAllNoSlash bool
+
+	// keys holds the result of Keys when any constraint has
+	// named groups; otherwise it is nil and Keys returns vars.
+	keys []string
 }
 
 // String returns the string representation of the pattern.
@@ -24,24 +62,126 @@ func (p *Pattern) String() string {
 	r := make([]byte, 0, size)
 	for i, s := range p.static {
 		if s != "" {
-			r = append(r, s...)
+			r = appendEscaped(r, s)
 			continue
 		}
-		if p.catchAll && i == len(p.static)-1 {
+		switch {
+		case p.catchAll && i == len(p.static)-1:
 			r = append(r, '*')
-		} else {
+		case p.isMulti(i / 2):
+			r = append(r, "**"...)
+		default:
 			r = append(r, ':')
 		}
 		r = append(r, p.vars[i/2]...)
+		if c := p.constraintAt(i / 2); c != nil {
+			r = append(r, '(')
+			r = append(r, c.src...)
+			r = append(r, ')')
+		}
+		if p.optional && i == len(p.static)-1 {
+			r = append(r, '?')
+		}
+	}
+	if p.optionalSlash {
+		r = append(r, "{/}"...)
+	}
+	return swapSeparator(string(r), p.sep)
+}
+
+// separator returns the segment separator for p.
+func (p *Pattern) separator() byte {
+	if p.sep == 0 {
+		return '/'
+	}
+	return p.sep
+}
+
+// variant returns the alternative form of the pattern that
+// is registered alongside it, or nil if there is none.
+func (p *Pattern) variant() *Pattern {
+	switch {
+	case p.optionalSlash:
+		return p.withTrailingSlash()
+	case p.optional:
+		return p.withoutOptional()
+	}
+	return nil
+}
+
+// withoutOptional returns the variant of a pattern ending in an
+// optional wildcard that matches paths without the final segment.
+// The result has one fewer variable than p.
+func (p *Pattern) withoutOptional() *Pattern {
+	p1 := *p
+	p1.optional = false
+	nvars := len(p.vars) - 1
+	p1.vars = p.vars[:nvars]
+	if len(p1.multi) > nvars {
+		p1.multi = p1.multi[:nvars]
 	}
-	return string(r)
+	if len(p1.constraints) > nvars {
+		p1.constraints = p1.constraints[:nvars]
+	}
+	p1.keys = p1.groupKeys()
+	// Remove the final wildcard and the slash before it.
+	n := len(p.static) - 1
+	p1.static = append([]string(nil), p.static[:n]...)
+	last := p1.static[n-1]
+	p1.staticSize -= len(last)
+	last = last[:len(last)-1]
+	if n-1 == 0 && last == "" {
+		// The pattern is "/:name?", whose variant is "/".
+		last = "/"
+	}
+	p1.staticSize += len(last)
+	if last == "" {
+		// The wildcard followed another wildcard.
+		p1.static = p1.static[:n-1]
+	} else {
+		p1.static[n-1] = last
+	}
+	return &p1
+}
+
+// withTrailingSlash returns the variant of a pattern ending in "{/}"
+// that matches paths with a trailing slash. The result matches the
+// same variables as p.
+func (p *Pattern) withTrailingSlash() *Pattern {
+	p1 := *p
+	p1.optionalSlash = false
+	p1.static = append([]string(nil), p.static...)
+	if len(p1.static)%2 == 1 {
+		p1.static[len(p1.static)-1] += "/"
+	} else {
+		p1.static = append(p1.static, "/")
+	}
+	p1.staticSize++
+	return &p1
+}
+
+// constraint holds a regular expression that constrains
+// the value of a wildcard variable.
+type constraint struct {
+	// src holds the regular expression as written in the pattern.
+	src string
+
+	// re holds the compiled expression, anchored
+	// so that it must match the whole value.
+	re *regexp.Regexp
+}
+
+// literal reports whether c matches only a single literal string.
+func (c *constraint) literal() bool {
+	_, complete := c.re.LiteralPrefix()
+	return complete
 }
 
 // Each non-empty element of Pattern.static holds a static segment of
 // the path. Each element of vars holds the name of a wildcard variable
 // inside the path between two pattern segments. If catchAll is true,
 // the last variable is a * pattern that matches any number of trailing
-// path elements.
+// path elements. Any variable recorded in multi is a ** pattern.
 //
 // Every place in static corresponding to a wildcard variable is empty.
 // The variable for static[i] is at vars[i/2].
@@ -77,9 +217,99 @@ func (p *Pattern) String() string {
 //	/foo/*name
 //
 // would match /foo/info and /foo/bar/info.
+//
+// A multi-segment wildcard of the form **param matches one or more
+// path segments. It must be preceded by a "/" and, unlike a catch-all,
+// must be followed by a static segment. The longest possible match is
+// used. The value of a multi-segment parameter holds the matched
+// segments separated by slashes, with no leading or trailing slash.
+//
+// For example:
+//
+//	/a/**mid/z
+//
+// would match /a/x/y/z with mid set to "x/y".
+//
+// The value of a :param segment may be constrained by a regular
+// expression in parentheses immediately after the name. The
+// expression must match the whole segment and may not contain
+// a "/". When a path matches both a constrained and an
+// unconstrained variable at the same position, the constrained
+// route is preferred. When the constraints of several variables at
+// the same position match, a constraint that matches only literal
+// text is preferred; otherwise the constraints are tried in
+// lexical order of their expressions, regardless of the order
+// in which the routes were registered.
+//
+// For example:
+//
+//	/user/:id(\d+)
+//
+// would match /user/42 but not /user/abc.
+//
+// A segment may hold several :param variables separated by static
+// text, in which case the variable names may contain only letters,
+// digits and underscores. Where there is a choice, earlier variables
+// match as much as possible.
+//
+// For example:
+//
+//	/files/:name.:ext
+//
+// would match /files/report.tar.gz with name set to "report.tar"
+// and ext set to "gz".
+//
+// A pattern that does not end in a slash or a catch-all may end in
+// "{/}" to match paths both with and without a trailing slash, so
+// neither form is redirected to the other. Path returns the form
+// without the slash.
+//
+// For example:
+//
+//	/users/:id{/}
+//
+// would match both /users/42 and /users/42/.
+//
+// A :param wildcard that is the whole of the final segment may be
+// made optional by following it with "?" (after any constraint), in
+// which case the pattern also matches the path without that segment,
+// and the parameter's value is empty. Path omits the segment when
+// given an empty value for it.
+//
+// For example:
+//
+//	/search/:q?
+//
+// would match /search/foo with q set to "foo" and /search with q
+// set to "".
+//
+// A literal ":" or "*" in static text must be escaped with a
+// backslash. String escapes them in the same way.
+//
+// For example:
+//
+//	/emoji/\:)
+//
+// would match only /emoji/:).
 func ParsePattern(p string) (*Pattern, error) {
+	orig := p
+	optionalSlash := strings.HasSuffix(p, "{/}")
+	if optionalSlash {
+		p = p[:len(p)-len("{/}")]
+	}
+	whole := p
+	fail := func(rest string, err error) (*Pattern, error) {
+		return nil, &PatternError{
+			Pattern: orig,
+			Offset:  len(whole) - len(rest),
+			Err:     err,
+		}
+	}
+	if optionalSlash && (p == "" || strings.HasSuffix(p, "/")) {
+		return fail("", ErrInvalidOptionalSlash)
+	}
 	if CleanPath(p) != p {
-		return nil, fmt.Errorf("pattern is not clean")
+		return fail(whole, ErrNotClean)
 	}
 	n := 0
 	for i := 0; i < len(p); i++ {
@@ -93,66 +323,513 @@ func ParsePattern(p string) (*Pattern, error) {
 	}
 
 	if !strings.HasPrefix(p, "/") {
-		return nil, fmt.Errorf("path must start with /")
+		return fail(whole, ErrNoLeadingSlash)
 	}
 	for len(p) > 0 {
-		i := strings.IndexAny(p, ":*")
+		i := indexUnescaped(p, ":*")
 		if i == -1 {
-			pat.static = append(pat.static, p)
+			pat.static = append(pat.static, unescapeStatic(p))
 			break
 		}
 		if i == 0 {
 			panic("unexpected empty path segment")
 		}
-		pat.static = append(pat.static, p[0:i])
+		pat.static = append(pat.static, unescapeStatic(p[0:i]))
 		if p[i-1] != '/' {
-			return nil, fmt.Errorf("no / before wildcard segment")
+			return fail(p[i:], ErrWildcardNotPreceded)
 		}
 		p = p[i:]
+		// wild holds the rest of the pattern starting at the
+		// wildcard, for error reporting.
+		wild := p
+		multi := strings.HasPrefix(p, "**")
 		i = strings.Index(p, "/")
 		if i == -1 {
-			pat.static = append(pat.static, "")
-			pat.vars = append(pat.vars, p[1:])
-			pat.catchAll = p[0] == '*'
-			break
-		}
-		if p[0] == '*' {
-			return nil, fmt.Errorf("catch-all route not at end of path")
+			i = len(p)
 		}
-		v := p[1:i]
-		if strings.IndexAny(v, ":*") != -1 {
-			return nil, fmt.Errorf("no / before wildcard segment")
-		}
-		pat.static = append(pat.static, "")
-		pat.vars = append(pat.vars, v)
+		seg := p[:i]
 		p = p[i:]
+		switch {
+		case multi:
+			if p == "" {
+				return fail(wild, ErrMultiNotFollowed)
+			}
+			v := seg[2:]
+			if strings.Contains(v, "(") {
+				return fail(wild, ErrConstraintOnMulti)
+			}
+			if strings.IndexAny(v, ":*") != -1 {
+				return fail(wild, ErrWildcardNotPreceded)
+			}
+			for len(pat.multi) < len(pat.vars) {
+				pat.multi = append(pat.multi, false)
+			}
+			pat.multi = append(pat.multi, true)
+			pat.static = append(pat.static, "")
+			pat.vars = append(pat.vars, v)
+		case seg[0] == '*':
+			if p != "" {
+				return fail(wild, ErrCatchAllNotAtEnd)
+			}
+			v := seg[1:]
+			if strings.Contains(v, "(") {
+				return fail(wild, ErrConstraintOnCatchAll)
+			}
+			pat.catchAll = true
+			pat.static = append(pat.static, "")
+			pat.vars = append(pat.vars, v)
+		default:
+			optional := strings.HasSuffix(seg, "?")
+			if optional {
+				seg = seg[:len(seg)-1]
+			}
+			nvars := len(pat.vars)
+			rest, err := pat.addSegmentVars(seg[1:])
+			if err != nil {
+				return fail(wild, err)
+			}
+			if optional {
+				if p != "" || rest != "" || len(pat.vars) != nvars+1 || optionalSlash {
+					return fail(wild, ErrInvalidOptional)
+				}
+				pat.optional = true
+			}
+			// Any static text after the last variable in the
+			// segment is part of the next static element.
+			p = rest + p
+		}
+	}
+	if optionalSlash && pat.catchAll {
+		return fail("", ErrInvalidOptionalSlash)
 	}
 	size := 0
 	for _, s := range pat.static {
 		size += len(s)
 	}
 	pat.staticSize = size
+	pat.optionalSlash = optionalSlash
+	pat.keys = pat.groupKeys()
 	return &pat, nil
 }
 
+// PatternError is the type of the error returned by ParsePattern.
+// Its Err field holds one of the Err* sentinel errors defined in this
+// package, so the kind of error can be checked with errors.Is.
+type PatternError struct {
+	// Pattern holds the pattern that could not be parsed.
+	Pattern string
+
+	// Offset holds the byte offset in Pattern of the start
+	// of the offending wildcard segment, or zero if the
+	// error applies to the whole pattern.
+	Offset int
+
+	// Err holds the underlying error.
+	Err error
+}
+
+// Error implements the error interface. For compatibility with
+// earlier versions, the message does not include the pattern.
+func (e *PatternError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *PatternError) Unwrap() error {
+	return e.Err
+}
+
+// Errors that can be found in a *PatternError returned by ParsePattern.
+var (
+	ErrNotClean               = errors.New("pattern is not clean")
+	ErrNoLeadingSlash         = errors.New("path must start with /")
+	ErrWildcardNotPreceded    = errors.New("no / before wildcard segment")
+	ErrMultiNotFollowed       = errors.New("multi-segment wildcard not followed by static segment")
+	ErrCatchAllNotAtEnd       = errors.New("catch-all route not at end of path")
+	ErrConstraintOnMulti      = errors.New("constraint not allowed on multi-segment wildcard")
+	ErrConstraintOnCatchAll   = errors.New("constraint not allowed on catch-all wildcard")
+	ErrConstraintInSegment    = errors.New("constraint not allowed in segment with static text or several wildcards")
+	ErrInvalidWildcardName    = errors.New("invalid wildcard name in segment")
+	ErrAdjacentWildcards      = errors.New("wildcards in segment not separated by static text")
+	ErrUnterminatedConstraint = errors.New("unterminated constraint")
+	ErrInvalidOptionalSlash   = errors.New("{/} must not follow a slash or a catch-all wildcard")
+	ErrInvalidOptional        = errors.New("optional wildcard must be the whole of the final segment")
+
+	// ErrInvalidConstraint is used when a constraint is not a valid
+	// regular expression. The error wrapping it also wraps the error
+	// returned by regexp.Compile.
+	ErrInvalidConstraint = errors.New("invalid constraint")
+)
+
+// addSegmentVars adds the variables in the given segment text, which
+// starts just after the colon of a :param wildcard, to p. A segment
+// may hold several variables separated by static text, in which case
+// their names are limited to letters, digits and underscores. It
+// returns any static text that follows the last variable.
+func (p *Pattern) addSegmentVars(seg string) (string, error) {
+	// Any constraint applies to the whole segment, so the
+	// text before it determines whether the segment holds
+	// several variables.
+	name, _, hasConstraint := strings.Cut(seg, "(")
+	if several := indexUnescaped(name, ":") != -1 || hasEscape(name); !several || hasConstraint {
+		if several {
+			return "", ErrConstraintInSegment
+		}
+		v, err := p.addConstraint(seg)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(v, "*") {
+			return "", ErrWildcardNotPreceded
+		}
+		p.static = append(p.static, "")
+		p.vars = append(p.vars, v)
+		return "", nil
+	}
+	for {
+		i := 0
+		for i < len(seg) && isNameByte(seg[i]) {
+			i++
+		}
+		if i == 0 {
+			return "", ErrInvalidWildcardName
+		}
+		p.static = append(p.static, "")
+		p.vars = append(p.vars, seg[:i])
+		seg = seg[i:]
+		i = indexUnescaped(seg, ":")
+		if i == -1 {
+			if indexUnescaped(seg, "*") != -1 {
+				return "", ErrWildcardNotPreceded
+			}
+			return seg, nil
+		}
+		if i == 0 {
+			return "", ErrAdjacentWildcards
+		}
+		if indexUnescaped(seg[:i], "*") != -1 {
+			return "", ErrWildcardNotPreceded
+		}
+		p.static = append(p.static, unescapeStatic(seg[:i]))
+		seg = seg[i+1:]
+	}
+}
+
+// indexUnescaped returns the index of the first byte in s that is
+// one of the bytes in chars and is not escaped, or -1 if there is none.
+// A ':' or '*' is escaped by a preceding backslash.
+func indexUnescaped(s, chars string) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == ':' || s[i+1] == '*'):
+			i++
+		case strings.IndexByte(chars, s[i]) != -1:
+			return i
+		}
+	}
+	return -1
+}
+
+// hasEscape reports whether s holds an escaped ':' or '*'.
+func hasEscape(s string) bool {
+	return strings.Contains(s, `\:`) || strings.Contains(s, `\*`)
+}
+
+// staticUnescaper replaces the escapes in static pattern text.
+var staticUnescaper = strings.NewReplacer(`\:`, ":", `\*`, "*")
+
+// unescapeStatic returns the static pattern text s
+// with any escaped ':' or '*' characters unescaped.
+func unescapeStatic(s string) string {
+	if !hasEscape(s) {
+		return s
+	}
+	return staticUnescaper.Replace(s)
+}
+
+// appendEscaped appends the static text s to b, escaping
+// any ':' or '*' characters so that they are not taken
+// as wildcards when the result is parsed.
+func appendEscaped(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' || s[i] == '*' {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// isNameByte reports whether b may be part of the name of a
+// variable in a segment with several variables.
+func isNameByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '_'
+}
+
+// addConstraint parses any regular expression constraint
+// in the given :param segment text (without the leading colon)
+// and records it for the variable that is about to be added
+// to p. It returns the variable name.
+func (p *Pattern) addConstraint(v string) (string, error) {
+	i := strings.IndexByte(v, '(')
+	if i == -1 {
+		return v, nil
+	}
+	if !strings.HasSuffix(v, ")") {
+		return "", ErrUnterminatedConstraint
+	}
+	name, src := v[:i], v[i+1:len(v)-1]
+	re, err := regexp.Compile("^(?:" + src + ")$")
+	if err != nil {
+		return "", fmt.Errorf("%w for %q: %w", ErrInvalidConstraint, name, err)
+	}
+	for len(p.constraints) < len(p.vars) {
+		p.constraints = append(p.constraints, nil)
+	}
+	p.constraints = append(p.constraints, &constraint{
+		src: src,
+		re:  re,
+	})
+	return name, nil
+}
+
+// ParsePatternClean is like ParsePattern except that the pattern is
+// cleaned with CleanPath before being parsed, so, for example,
+// "/a//b/:c" is parsed as "/a/b/:c". This is useful when patterns are
+// constructed programmatically.
+func ParsePatternClean(p string) (*Pattern, error) {
+	return ParsePattern(CleanPath(p))
+}
+
 // CatchAll reports whether the pattern has a :* suffix
 // which will catch all paths unde+
 func (p *Pattern) CatchAll() bool {
 	return p.catchAll
 }
 
+// Equal reports whether p and p1 have the same structure, so that they
+// match the same paths and produce the same parameters. Two nil patterns
+// are equal.
+func (p *Pattern) Equal(p1 *Pattern) bool {
+	if p == nil || p1 == nil {
+		return p == p1
+	}
+	return p.sep == p1.sep && p.catchAllNoSlash == p1.catchAllNoSlash && p.String() == p1.String()
+}
+
+// Matches reports whether the given path matches p, and if so,
+// returns the parameters that a router would pass to the route's
+// handler. It uses the same matching rules as Router but does not
+// perform any path correction or redirection.
+func (p *Pattern) Matches(path string) (Params, bool) {
+	return p.match(p.tree(), path)
+}
+
+// tree returns a routing tree holding only p, for use by match.
+func (p *Pattern) tree() *node {
+	root := &node{
+		path: "/",
+	}
+	root.addRoute(p, handlerEntry{
+		method:  "*",
+		pattern: p,
+	})
+	return root
+}
+
+// match implements Matches using the tree returned by p.tree.
+func (p *Pattern) match(root *node, path string) (Params, bool) {
+	e, ps, _ := root.getValue("*", swapSeparator(path, p.sep), nil, paramsAlloc{})
+	if e == nil {
+		return nil, false
+	}
+	if p.catchAll && p.catchAllNoSlash {
+		last := &ps[len(ps)-1]
+		last.Value = strings.TrimPrefix(last.Value, "/")
+	}
+	for i := range ps {
+		ps[i].Value = swapSeparator(ps[i].Value, p.sep)
+	}
+	return ps, true
+}
+
+// Segment describes one slash-separated element of a pattern.
+type Segment struct {
+	// Wildcard reports whether the segment is a variable.
+	Wildcard bool
+
+	// Text holds the text of a static segment or the
+	// variable name of a wildcard segment.
+	Text string
+
+	// CatchAll reports whether the segment is a *name
+	// catch-all wildcard.
+	CatchAll bool
+
+	// Multi reports whether the segment is a **name
+	// multi-segment wildcard.
+	Multi bool
+
+	// Optional reports whether the segment is a :name?
+	// optional wildcard.
+	Optional bool
+
+	// Constraint holds the regular expression that constrains
+	// the value of a wildcard segment, or the empty string
+	// if there is none.
+	Constraint string
+}
+
+// Segments returns the elements of the pattern in order. For example,
+// the segments of "/users/:id/posts" are the static segment "users",
+// the wildcard segment "id" and the static segment "posts". Empty
+// elements, such as those implied by the leading slash and any
+// trailing slash, are omitted.
+func (p *Pattern) Segments() []Segment {
+	var segs []Segment
+	for i, s := range p.static {
+		if s != "" {
+			for _, elem := range strings.Split(s, "/") {
+				if elem != "" {
+					segs = append(segs, Segment{
+						Text: swapSeparator(elem, p.sep),
+					})
+				}
+			}
+			continue
+		}
+		seg := Segment{
+			Wildcard: true,
+			Text:     p.vars[i/2],
+			CatchAll: p.catchAll && i == len(p.static)-1,
+			Multi:    p.isMulti(i / 2),
+			Optional: p.optional && i == len(p.static)-1,
+		}
+		if c := p.constraintAt(i / 2); c != nil {
+			seg.Constraint = c.src
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// isMulti reports whether the variable at index i
+// is a multi-segment wildcard.
+func (p *Pattern) isMulti(i int) bool {
+	return i < len(p.multi) && p.multi[i]
+}
+
+// constraintAt returns the constraint on the variable
+// at index i, or nil if there is none.
+func (p *Pattern) constraintAt(i int) *constraint {
+	if i < len(p.constraints) {
+		return p.constraints[i]
+	}
+	return nil
+}
+
 // Keys returns all the parameter keys specified
 // in the pattern. The caller must not change
 // the elements of the returned slice.
+//
+// The names of any named groups in constraints, such as
+// major in /:ver(v(?P<major>\d+)), are included after the
+// wildcard names but before the name of any final catch-all,
+// which always comes last. The router sets their values from
+// the text matched by the group.
 func (p *Pattern) Keys() []string {
+	if p.keys != nil {
+		return p.keys
+	}
 	return p.vars
 }
 
+// groupKeys returns the keys for Keys if any of p's constraints
+// has named groups, or nil otherwise.
+func (p *Pattern) groupKeys() []string {
+	var groups []string
+	for _, c := range p.constraints {
+		if c == nil {
+			continue
+		}
+		for _, name := range c.re.SubexpNames() {
+			if name != "" {
+				groups = append(groups, name)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	n := len(p.vars)
+	if p.catchAll {
+		n--
+	}
+	keys := make([]string, 0, len(p.vars)+len(groups))
+	keys = append(keys, p.vars[:n]...)
+	keys = append(keys, groups...)
+	return append(keys, p.vars[n:]...)
+}
+
+// numGroups returns the number of named groups
+// in the constraints of p.
+func (p *Pattern) numGroups() int {
+	if p == nil || p.keys == nil {
+		return 0
+	}
+	return len(p.keys) - len(p.vars)
+}
+
+// addGroups returns ps, which holds a value for each wildcard in
+// p, with a parameter added for each named group in p's constraints,
+// as described in Keys. The parameter keys are left unset.
+func (p *Pattern) addGroups(ps Params) Params {
+	if p.keys == nil {
+		return ps
+	}
+	n := len(p.vars)
+	var last Param
+	if p.catchAll {
+		n--
+		last = ps[n]
+	}
+	ps = ps[:n]
+	for i := 0; i < n; i++ {
+		c := p.constraintAt(i)
+		if c == nil {
+			continue
+		}
+		m := c.re.FindStringSubmatch(ps[i].Value)
+		for j, name := range c.re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			// A group that took no part in the match,
+			// as when an optional wildcard is empty,
+			// has an empty value.
+			var val string
+			if m != nil {
+				val = m[j]
+			}
+			ps = append(ps, Param{Value: val})
+		}
+	}
+	if p.catchAll {
+		ps = append(ps, last)
+	}
+	return ps
+}
+
 // Path returns a path constructed by interpolating the
 // given parameter values. All the parameter values
-// must be non-empty. Each value corresponds to
+// must be non-empty and must match any constraints
+// in the pattern. Only the values of catch-all and
+// multi-segment wildcards may contain a slash
+// (or the router's Separator, if set).
+// Each value corresponds to
 // the parameter at the same position in the slice
-// returned by Keys.
+// returned by Keys, except that no values are given
+// for named groups in constraints.
 //
 // For example, if the original pattern path
 // was /foo/:name/*rest then Keys would
@@ -162,6 +839,26 @@ func (p *Pattern) Path(vals ...string) (string, error) {
 	if len(vals) != len(p.vars) {
 		return "", errgo.Newf("too few parameters")
 	}
+	if p.sep == 0 {
+		return p.path(vals)
+	}
+	vals1 := make([]string, len(vals))
+	for i, val := range vals {
+		vals1[i] = swapSeparator(val, p.sep)
+	}
+	path, err := p.path(vals1)
+	if err != nil {
+		return "", err
+	}
+	return swapSeparator(path, p.sep), nil
+}
+
+// path implements Path for values that use '/'
+// as the separator.
+func (p *Pattern) path(vals []string) (string, error) {
+	if p.optional && vals[len(vals)-1] == "" {
+		return p.withoutOptional().path(vals[:len(vals)-1])
+	}
 	size := p.staticSize
 	for _, val := range vals {
 		size += len(val)
@@ -174,25 +871,98 @@ func (p *Pattern) Path(vals ...string) (string, error) {
 		}
 		val := vals[i/2]
 		if i == len(p.static)-1 && p.catchAll {
-			if !strings.HasPrefix(val, "/") {
-				return "", errgo.Newf("catch-all parameter without / prefix")
+			switch {
+			case p.catchAllNoSlash && strings.HasPrefix(val, "/"):
+				return "", errgo.Newf("catch-all parameter with %c prefix", p.separator())
+			case p.catchAllNoSlash:
+				// The static text before the catch-all
+				// already ends with the separator.
+			case !strings.HasPrefix(val, "/"):
+				return "", errgo.Newf("catch-all parameter without %c prefix", p.separator())
+			default:
+				val = val[1:]
 			}
-			val = val[1:]
 		} else {
 			if val == "" {
 				return "", errgo.Newf("empty parameter")
 			}
-			// TODO check that val does not contain a / ?
+			if !p.isMulti(i/2) && strings.Contains(val, "/") {
+				return "", errgo.Newf("parameter %q contains %c", p.vars[i/2], p.separator())
+			}
+			if c := p.constraintAt(i / 2); c != nil && !c.re.MatchString(val) {
+				return "", errgo.Newf("parameter %q does not match constraint", p.vars[i/2])
+			}
 		}
 		path = append(path, val...)
 	}
 	return string(path), nil
 }
 
+// MakeParams returns the parameters that the router would produce
+// for a path matching p with the given parameter values, which
+// must be provided in the same order as the keys returned by p.Keys,
+// leaving out any named groups in constraints, whose values are
+// derived from the values given.
+// As with Path, a catch-all value must start with a slash
+// (or the router's Separator, if set) unless the pattern was
+// registered with a router with CatchAllNoLeadingSlash set,
+// in which case it must not.
+func (p *Pattern) MakeParams(vals ...string) (Params, error) {
+	if len(vals) != len(p.vars) {
+		return nil, errgo.Newf("got %d parameters, want %d", len(vals), len(p.vars))
+	}
+	if last := len(vals) - 1; p.catchAll {
+		hasPrefix := vals[last] != "" && vals[last][0] == p.separator()
+		switch {
+		case p.catchAllNoSlash && hasPrefix:
+			return nil, errgo.Newf("catch-all parameter with %c prefix", p.separator())
+		case !p.catchAllNoSlash && !hasPrefix:
+			return nil, errgo.Newf("catch-all parameter without %c prefix", p.separator())
+		}
+	}
+	ps := make(Params, len(vals), len(p.Keys()))
+	for i, val := range vals {
+		ps[i].Value = val
+	}
+	ps = p.addGroups(ps)
+	for i, key := range p.Keys() {
+		ps[i].Key = key
+	}
+	return ps, nil
+}
+
+// pathWithKeyVals is like PathWithParams except that the
+// parameters are taken from alternating key and value pairs in kv.
+func (p *Pattern) pathWithKeyVals(kv []string) (string, error) {
+	if len(kv)%2 != 0 {
+		return "", errgo.Newf("odd number of key/value arguments")
+	}
+	ps := make(Params, len(kv)/2)
+	for i := range ps {
+		ps[i] = Param{
+			Key:   kv[i*2],
+			Value: kv[i*2+1],
+		}
+	}
+	return p.PathWithParams(ps)
+}
+
 // PathWithParams returns a path constructed by interpolating
 // the parameter values in p, which must contain elements
 // with all the keys returned by p.Keys.
-func (p *Pattern) PathWithParams(Params) (string, error) {
-	// TODO implement.
-	return "", errgo.Newf("unimplemented")
+func (p *Pattern) PathWithParams(ps Params) (string, error) {
+	vals := make([]string, len(p.vars))
+	for i, key := range p.vars {
+		found := false
+		for _, param := range ps {
+			if param.Key == key {
+				vals[i], found = param.Value, true
+				break
+			}
+		}
+		if !found && !(p.optional && i == len(p.vars)-1) {
+			return "", errgo.Newf("no value for parameter %q", key)
+		}
+	}
+	return p.Path(vals...)
 }
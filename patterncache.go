@@ -0,0 +1,71 @@
+package hroute
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CachingParser parses patterns, caching the most recently used
+// results so that parsing the same pattern string again returns the
+// same *Pattern value. This is useful when patterns are supplied at
+// runtime and the same ones are parsed repeatedly. A Pattern should
+// not be changed after it is returned by ParsePattern, so it is safe
+// to share between callers.
+//
+// It is OK to call methods on a CachingParser concurrently.
+type CachingParser struct {
+	mu   sync.Mutex
+	size int
+
+	// lru holds an element for each cached pattern,
+	// most recently used first. The value of each
+	// element is a *cachedPattern.
+	lru *list.List
+
+	// elems maps from pattern string to its element in lru.
+	elems map[string]*list.Element
+}
+
+type cachedPattern struct {
+	s   string
+	pat *Pattern
+}
+
+// NewCachingParser returns a CachingParser that holds
+// at most size patterns.
+func NewCachingParser(size int) *CachingParser {
+	return &CachingParser{
+		size:  size,
+		lru:   list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+// ParsePattern is like the ParsePattern function except that
+// it returns a cached result if there is one. Patterns that
+// fail to parse are not cached.
+func (c *CachingParser) ParsePattern(p string) (*Pattern, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[p]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cachedPattern).pat, nil
+	}
+	pat, err := ParsePattern(p)
+	if err != nil {
+		return nil, err
+	}
+	if c.size <= 0 {
+		return pat, nil
+	}
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.elems, oldest.Value.(*cachedPattern).s)
+	}
+	c.elems[p] = c.lru.PushFront(&cachedPattern{
+		s:   p,
+		pat: pat,
+	})
+	return pat, nil
+}
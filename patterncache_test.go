@@ -0,0 +1,39 @@
+package hroute_test
+
+import (
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestCachingParser(t *testing.T) {
+	c := hroute.NewCachingParser(2)
+	a1 := mustParse(t, c, "/a/:x")
+	if a2 := mustParse(t, c, "/a/:x"); a2 != a1 {
+		t.Fatalf("pattern not cached")
+	}
+	b1 := mustParse(t, c, "/b")
+	// Use /a/:x so that /b becomes the least recently used.
+	mustParse(t, c, "/a/:x")
+	mustParse(t, c, "/c")
+	if a2 := mustParse(t, c, "/a/:x"); a2 != a1 {
+		t.Fatalf("recently used pattern was evicted")
+	}
+	if b2 := mustParse(t, c, "/b"); b2 == b1 {
+		t.Fatalf("least recently used pattern was not evicted")
+	}
+	if _, err := c.ParsePattern("bad"); err == nil {
+		t.Fatalf("expected error from bad pattern")
+	}
+}
+
+func mustParse(t *testing.T, c *hroute.CachingParser, p string) *hroute.Pattern {
+	pat, err := c.ParsePattern(p)
+	if err != nil {
+		t.Fatalf("cannot parse %q: %v", p, err)
+	}
+	if got := pat.String(); got != p {
+		t.Fatalf("unexpected pattern; got %q want %q", got, p)
+	}
+	return pat
+}
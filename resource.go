@@ -0,0 +1,51 @@
+package hroute
+
+import (
+	"strings"
+)
+
+// ResourceHandler holds the handlers for the conventional
+// routes of a REST resource, as registered by Router.Resource.
+// Any nil handler is not registered.
+type ResourceHandler struct {
+	// List is registered for GET on the base path.
+	List Handler
+
+	// Create is registered for POST on the base path.
+	Create Handler
+
+	// Show is registered for GET on the base path
+	// followed by /:id.
+	Show Handler
+
+	// Update is registered for PUT on the base path
+	// followed by /:id.
+	Update Handler
+
+	// Delete is registered for DELETE on the base path
+	// followed by /:id.
+	Delete Handler
+}
+
+// Resource registers the non-nil handlers in h for the conventional
+// REST routes under basePath. For example, if basePath is "/users",
+// h.Show will be registered for GET /users/:id. The id of the resource
+// is available to the handlers as the "id" parameter.
+func (r *Router) Resource(basePath string, h ResourceHandler) {
+	itemPath := strings.TrimSuffix(basePath, "/") + "/:id"
+	for _, route := range []struct {
+		method  string
+		pattern string
+		handler Handler
+	}{
+		{"GET", basePath, h.List},
+		{"POST", basePath, h.Create},
+		{"GET", itemPath, h.Show},
+		{"PUT", itemPath, h.Update},
+		{"DELETE", itemPath, h.Delete},
+	} {
+		if route.handler != nil {
+			r.Handle(route.method, route.pattern, route.handler)
+		}
+	}
+}
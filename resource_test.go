@@ -0,0 +1,48 @@
+package hroute_test
+
+import (
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestResource(t *testing.T) {
+	r := hroute.New()
+	r.Resource("/users", hroute.ResourceHandler{
+		List:   nopHandler("list"),
+		Create: nopHandler("create"),
+		Show:   nopHandler("show"),
+		Update: nopHandler("update"),
+		Delete: nopHandler("delete"),
+	})
+	for _, test := range []struct {
+		method string
+		path   string
+		expect hroute.Handler
+	}{
+		{"GET", "/users", nopHandler("list")},
+		{"POST", "/users", nopHandler("create")},
+		{"GET", "/users/42", nopHandler("show")},
+		{"PUT", "/users/42", nopHandler("update")},
+		{"DELETE", "/users/42", nopHandler("delete")},
+	} {
+		h, p, _ := r.Handler(test.method, test.path)
+		if h != test.expect {
+			t.Errorf("unexpected handler for %s %s; got %#v want %#v", test.method, test.path, h, test.expect)
+		}
+		if test.path != "/users" && p.Get("id") != "42" {
+			t.Errorf("unexpected params for %s %s: %#v", test.method, test.path, p)
+		}
+	}
+
+	r = hroute.New()
+	r.Resource("/users", hroute.ResourceHandler{
+		Show: nopHandler("show"),
+	})
+	if h, _, _ := r.Handler("PUT", "/users/42"); h != nil {
+		t.Errorf("unexpected handler for nil Update: %#v", h)
+	}
+	if h, _, _ := r.Handler("GET", "/users"); h != nil {
+		t.Errorf("unexpected handler for nil List: %#v", h)
+	}
+}
@@ -36,12 +36,22 @@
 // - much of the naming has also been changed to be more consistent
 // with the net/http and its ServeMux type.
 //
-// - there is no case-insensitive path lookup.
+// - case-insensitive path lookup is only used to redirect to the
+// correctly cased path when Router.RedirectFixedPath is set.
 package hroute
 
 import (
+	"errors"
+	"fmt"
+	"maps"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"gopkg.in/errgo.v1"
 )
@@ -51,32 +61,246 @@ import (
 type Router struct {
 	root *node
 
-	// maxParams holds the maximum number of parameters
-	// used by any node.
-	// TODO store max per node so that we can allocate
-	// less for tree branches with less vars.
-	maxParams int
+	// frozen holds whether Freeze has been called.
+	frozen bool
 
-	// NotFoundHandler is the handler used when no matching route is found.
-	// If it is nil, NotFound{} is used.
+	// dynamic is set when EnableDynamicRoutes has been
+	// called. root is then nil and the routing tree is
+	// held in dynamic instead.
+	dynamic *dynamicTree
+
+	// localized maps from route name to locale to the
+	// pattern registered with HandleLocalized.
+	localized map[string]map[string]*Pattern
+
+	// named maps from route name to the pattern
+	// registered with WithName.
+	named map[string]*Pattern
+
+	// hosts maps from host name to the root of the
+	// tree holding the routes registered with Host.
+	hosts map[string]*node
+
+	// middleware holds the middleware registered with Use,
+	// outermost first.
+	middleware []func(Handler) Handler
+
+	// notFoundFor holds the handlers registered with NotFoundFor,
+	// longest prefix first. The prefixes use '/' as the separator.
+	notFoundFor []prefixHandler
+
+	// paramsPool holds *Params values for reuse
+	// when PoolParams is set.
+	paramsPool *sync.Pool
+
+	// NotFound is the handler used when no matching route is found,
+	// whether or not any route matches a prefix of the path,
+	// unless a handler registered with NotFoundFor covers the path.
+	// If it is nil, NotFound{} is used. See also JSONNotFound.
 	NotFound Handler
 
-	// MethodNotAllowedHandler is the handler used when a handler
+	// NotFoundByMethod maps from method to the handler to use
+	// instead of NotFound when no route is found for a request
+	// with that method. For example, a server that hosts both an
+	// API and a single-page application might use it to serve the
+	// application for any unmatched GET request while still
+	// returning a 404 response for other methods.
+	NotFoundByMethod map[string]Handler
+
+	// MethodNotAllowed is the handler used when a handler
 	// cannot be found for a given method but there is a handler
 	// for the requested path. If it is nil, MethodNotAllowed{} will be
-	// used.
+	// used. If it implements MethodNotAllowedHandler, its
+	// ServeMethodNotAllowed method is called instead of ServeRoute.
 	MethodNotAllowed Handler
 
 	// When Panic is not nil, panics in handlers will be
-	// recovered and PanicHandler will be called with the HTTP
+	// recovered and Panic will be called with the HTTP
 	// handler parameters, the Handler responsible for the panic and
 	// any parameters it was passed, and the recovered panic value.
 	//
 	// It should be used to generate a error page and return the
 	// http error code 500 (Internal Server Error). The handler can
 	// be used to keep your server from crashing because of
-	// unrecovered panics.
+	// unrecovered panics. RecoverHandler provides a suitable
+	// default.
 	Panic func(w http.ResponseWriter, req *http.Request, h Handler, p Params, err interface{})
+
+	// PanicStatus maps from the type of a recovered panic value
+	// to the HTTP status code to respond with. When a handler
+	// panics with a value of a type in the map, the panic is
+	// recovered and an error response with the corresponding
+	// status is written instead of calling Panic.
+	PanicStatus map[reflect.Type]int
+
+	// ErrorHandler, if not nil, is called to write the response
+	// whenever the router would otherwise use NotFound,
+	// MethodNotAllowed, RequestURITooLong, PanicStatus or Panic,
+	// with the HTTP status code of the response to write.
+	// For a recovered panic that has no entry in PanicStatus,
+	// the status is http.StatusInternalServerError. This
+	// allows all error pages to be rendered in one place.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, status int, p Params)
+
+	// NewParams, if not nil, is used to allocate the parameters
+	// for a matched route that has any wildcards. It is passed
+	// the maximum number of parameters that might be needed and
+	// should return a Params with zero length; if its capacity is
+	// less than n, it will be grown as needed. This allows the
+	// caller to control how parameters are allocated, for example
+	// by reusing memory. By default, make is used.
+	NewParams func(n int) Params
+
+	// PoolParams specifies that the memory used for the parameters
+	// passed to handlers by ServeHTTP and ServeSubroute should be
+	// reused for later requests. When it is set, a handler must not
+	// retain its Params or any slice of them after it returns; it
+	// should copy any values it needs to keep. PoolParams is ignored
+	// if NewParams is set.
+	PoolParams bool
+
+	// NormalizeMethod specifies that methods should be converted
+	// to upper case both when routes are registered and when they
+	// are looked up, so that, for example, a "get" request will
+	// match a route registered for "GET". It should be set before
+	// any routes are registered.
+	NormalizeMethod bool
+
+	// SetContext specifies that the parameters, pattern and options
+	// of the matched route should be stored in the request's context
+	// before the handler is called, where they can be retrieved
+	// with ParamsFromContext, MatchedPattern and MatchedOptions. This allows
+	// the router to be used with middleware and handlers written
+	// in terms of http.Handler.
+	SetContext bool
+
+	// MaxPathLength holds the maximum length of a path that
+	// will be routed. Longer paths are served with RequestURITooLong{}
+	// without consulting the routing tree. If it is zero, there is
+	// no limit.
+	MaxPathLength int
+
+	// MaxSegments holds the maximum number of segments in a path
+	// that will be routed, counted as the number of slashes (or
+	// Separator bytes) in the path. Paths with more segments are
+	// served with RequestURITooLong{} without consulting the routing
+	// tree. If it is zero, there is no limit.
+	MaxSegments int
+
+	// CleanPathRedirectCode, if non-zero, holds the status code
+	// used to redirect requests for unclean paths (see CleanPath)
+	// for all methods. Using http.StatusPermanentRedirect
+	// preserves the method and body of the request while
+	// still allowing caches to treat the redirect as permanent.
+	// If it is zero, http.StatusMovedPermanently is used for GET
+	// requests and http.StatusTemporaryRedirect for others.
+	CleanPathRedirectCode int
+
+	// RedirectCode, if non-zero, holds the status code used
+	// to redirect GET requests. If it is zero,
+	// http.StatusMovedPermanently is used.
+	RedirectCode int
+
+	// NonGETRedirectCode, if non-zero, holds the status code
+	// used to redirect requests with methods other than GET.
+	// If it is zero, http.StatusTemporaryRedirect is used.
+	// Note that only http.StatusTemporaryRedirect and
+	// http.StatusPermanentRedirect require clients to preserve
+	// the request method and body.
+	NonGETRedirectCode int
+
+	// DisableRedirects specifies that requests that match no
+	// route are never redirected to a clean path or to a
+	// path with or without a trailing slash; they are served
+	// with the NotFound handler instead.
+	DisableRedirects bool
+
+	// Separator holds the byte that separates segments in patterns
+	// and paths. If it is zero, '/' is used. Setting it to another
+	// byte allows the router to route names that are not URL
+	// paths, such as ".a.b.c" with a separator of '.'. Patterns and
+	// paths must then start with the separator, and a catch-all
+	// value starts with the separator instead of a slash. The
+	// separator and '/' are exchanged throughout, so a '/' in such a
+	// name is treated as ordinary text; it should not be used in
+	// constraints. Separator must not be changed after any routes
+	// have been registered.
+	Separator byte
+
+	// UseEncodedPath causes ServeHTTP to route requests using the
+	// percent-encoded form of the request path, as returned by
+	// req.URL.EscapedPath, rather than req.URL.Path, so that, for
+	// example, "/a%2Fb" matches the pattern "/:name" rather than
+	// "/:x/:y". Parameter values are decoded after the route has
+	// been found, so the handler sees name set to "a/b". If
+	// req.URL.RawPath is set but is not validly percent-encoded,
+	// BadRequest{} is used to serve the request.
+	// Patterns should use percent-encoding for any static text that
+	// would be encoded in a URL. UseEncodedPath does not affect
+	// ServeSubroute or ServeRoute.
+	UseEncodedPath bool
+
+	// CatchAllNoLeadingSlash causes the value of a catch-all
+	// parameter to be given without its leading slash, so that
+	// "/static/*path" matching "/static/css/app.css" gives path
+	// the value "css/app.css" rather than "/css/app.css". Patterns
+	// registered while it is set expect values in the same form
+	// when constructing paths. It must not be changed after any
+	// routes have been registered.
+	CatchAllNoLeadingSlash bool
+
+	// CheckContextCancel causes ServeHTTP, ServeSubroute and
+	// ServeRoute to check whether the request's context has been
+	// canceled before looking up the route. If it has, Canceled{}
+	// is used to serve the request instead of the route's handler
+	// and any middleware.
+	CheckContextCancel bool
+
+	// RedirectTrailingSlash specifies that a request that matches
+	// no route should be redirected to the same path with a
+	// trailing slash added or removed if a route matches that.
+	// It is true by default.
+	RedirectTrailingSlash bool
+
+	// RedirectCleanPath specifies that a request for a path
+	// that is not clean (see CleanPath) and that matches no route
+	// should be redirected to the cleaned path.
+	// It is true by default.
+	RedirectCleanPath bool
+
+	// AssumeCleanPath specifies that request paths are already
+	// clean, for example because a proxy in front of the server
+	// normalizes them. The router then never checks whether a path
+	// that matches no route is clean, so no clean-path redirect is
+	// made regardless of RedirectCleanPath, and the cost of calling
+	// CleanPath is avoided. Other redirects are unaffected. Use
+	// Router.Handler to look up a route without any redirects.
+	AssumeCleanPath bool
+
+	// HandleOPTIONS specifies that OPTIONS requests for a path
+	// that has routes registered but no OPTIONS route should be
+	// answered automatically with an Allow header listing the
+	// registered methods. Note that a route registered for the "*"
+	// method will serve OPTIONS requests itself.
+	HandleOPTIONS bool
+
+	// AutoHead specifies that HEAD requests for a path with
+	// no HEAD or "*" route should be served by the GET route
+	// for the path if there is one. Anything written to the response
+	// body by the GET handler is discarded.
+	AutoHead bool
+
+	// RedirectFixedPath specifies that when no route matches a
+	// request, the router should try to find a route that matches
+	// when the case of static path segments is ignored, and
+	// redirect to the path with the registered case if so.
+	// Wildcard values are left unchanged.
+	RedirectFixedPath bool
+
+	// Gzip specifies that all responses should be compressed
+	// with gzip when the client accepts it. To compress only
+	// the responses from particular routes, use WithGzip.
+	Gzip bool
 }
 
 // Param holds a path parameter that represents the value of
@@ -86,12 +310,17 @@ type Param struct {
 	Key string
 
 	// Value holds its value. When the wildcard is a "*",
-	// the value will always hold a leading slash.
+	// the value will always hold a leading slash unless
+	// Router.CatchAllNoLeadingSlash is set. When
+	// the wildcard is a "**", the value holds the matched
+	// segments separated by slashes, with no leading slash.
 	Value string
 }
 
 // Params represents the values for a set of wildcard parameters.
-// There will only be one instance of any given key.
+// There will only be one instance of any key that comes from a path
+// wildcard. Parameters derived from other sources, such as query
+// values, may have several instances of the same key; see GetAll.
 type Params []Param
 
 // Get returns the first value with the given key, or
@@ -105,6 +334,194 @@ func (ps Params) Get(key string) string {
 	return ""
 }
 
+// GetAll returns all the values with the given key,
+// in order, or nil if there are none.
+func (ps Params) GetAll(key string) []string {
+	var vals []string
+	for _, p := range ps {
+		if p.Key == key {
+			vals = append(vals, p.Value)
+		}
+	}
+	return vals
+}
+
+// lookup returns the first value with the given key and
+// reports whether it was found.
+func (ps Params) lookup(key string) (string, bool) {
+	for _, p := range ps {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// GetInt returns the first value with the given key parsed as a
+// decimal int. Unlike Get, it returns an error if the key is not
+// found or the value cannot be parsed, including when the value
+// is out of range.
+func (ps Params) GetInt(key string) (int, error) {
+	v, err := ps.getInt(key, strconv.IntSize)
+	return int(v), err
+}
+
+// GetInt64 is like GetInt but returns an int64.
+func (ps Params) GetInt64(key string) (int64, error) {
+	return ps.getInt(key, 64)
+}
+
+func (ps Params) getInt(key string, bitSize int) (int64, error) {
+	val, ok := ps.lookup(key)
+	if !ok {
+		return 0, errgo.Newf("parameter %q not found", key)
+	}
+	v, err := strconv.ParseInt(val, 10, bitSize)
+	if err != nil {
+		return 0, errgo.Notef(err, "invalid value for parameter %q", key)
+	}
+	return v, nil
+}
+
+// GetBool returns the first value with the given key parsed with
+// strconv.ParseBool. Like GetInt, it returns an error if the key
+// is not found or the value cannot be parsed.
+func (ps Params) GetBool(key string) (bool, error) {
+	val, ok := ps.lookup(key)
+	if !ok {
+		return false, errgo.Newf("parameter %q not found", key)
+	}
+	v, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errgo.Notef(err, "invalid value for parameter %q", key)
+	}
+	return v, nil
+}
+
+// Equal reports whether ps and other hold the same set of key-value
+// pairs, regardless of their order.
+func (ps Params) Equal(other Params) bool {
+	if len(ps) != len(other) {
+		return false
+	}
+outer:
+	for _, p := range ps {
+		for _, q := range other {
+			if q.Key == p.Key {
+				if q.Value != p.Value {
+					return false
+				}
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// String returns the parameters as key=value pairs in order,
+// separated by commas, for example "id=42, path=/a/b". It is
+// intended for logging and test failure messages.
+func (ps Params) String() string {
+	var b strings.Builder
+	for i, p := range ps {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(p.Key)
+		b.WriteByte('=')
+		b.WriteString(p.Value)
+	}
+	return b.String()
+}
+
+// Append returns ps with a parameter with the given key and value
+// added to the end. Like the built-in append, it may modify the
+// underlying array of ps. Because there can be only one instance of
+// a given key, Append panics if ps already contains the key.
+//
+// This can be used by a handler to pass extra information to a
+// subrouter.
+func (ps Params) Append(key, value string) Params {
+	for _, p := range ps {
+		if p.Key == key {
+			panic(errgo.Newf("duplicate parameter key %q", key))
+		}
+	}
+	return append(ps, Param{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Set returns ps with the value of the parameter with the given key
+// set to value, adding the parameter to the end if it is not already
+// present. Like Append, it may modify the underlying array of ps.
+//
+// This can be used by middleware to add or rewrite a parameter
+// before calling the next handler.
+func (ps Params) Set(key, value string) Params {
+	for i := range ps {
+		if ps[i].Key == key {
+			ps[i].Value = value
+			return ps
+		}
+	}
+	return append(ps, Param{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Del returns ps with any parameter with the given key removed. The
+// order of the remaining parameters is preserved. Like Append, it may
+// modify the underlying array of ps.
+func (ps Params) Del(key string) Params {
+	for i := range ps {
+		if ps[i].Key == key {
+			return append(ps[:i], ps[i+1:]...)
+		}
+	}
+	return ps
+}
+
+// WithQuery returns ps with the values of the given query parameters
+// from req.URL appended, in the order that the keys are given. A key
+// that occurs several times in the query contributes one parameter
+// for each value; a key that is absent from the query is left out, so
+// a handler that requires a query parameter should check for it.
+// Because path parameters come first, Get returns the path
+// parameter's value when a query key is the same as a wildcard name.
+// Like Append, it may modify the underlying array of ps.
+func (ps Params) WithQuery(req *http.Request, keys ...string) Params {
+	if len(keys) == 0 || req.URL.RawQuery == "" {
+		return ps
+	}
+	q := req.URL.Query()
+	for _, key := range keys {
+		for _, v := range q[key] {
+			ps = append(ps, Param{
+				Key:   key,
+				Value: v,
+			})
+		}
+	}
+	return ps
+}
+
+// ErrPass may be used as a panic value by a route's handler to
+// decline the request. The router then serves the request with
+// the next-best matching route, ignoring the pattern of each route
+// that has passed, or with the NotFound handler if there is none.
+// For example, a handler for "/:id" that passes will fall back
+// to a handler for "/*path".
+//
+// A handler that passes must not have written anything to the
+// response. The router's middleware (see Router.Use) runs only once
+// however many routes are tried, but the PreHandler and middleware
+// given as route options run for each route that is tried.
+var ErrPass = errors.New("route passed")
+
 // Handler is the interface implemented by hroute HTTP handlers.
 // See HTTPHandler for an adaptor that will put the parameters
 // into the request context (only available on Go 1.7 and later).
@@ -119,58 +536,918 @@ func New() *Router {
 		root: &node{
 			path: "/",
 		},
-		NotFound:         NotFound{},
-		MethodNotAllowed: MethodNotAllowed{},
+		NotFound:              NotFound{},
+		MethodNotAllowed:      MethodNotAllowed{},
+		RedirectTrailingSlash: true,
+		RedirectCleanPath:     true,
+		paramsPool:            new(sync.Pool),
 	}
 }
 
 // Handle registers the handler for the given pattern and methods.
 // If a handler is already registered for the given pattern
-// or the pattern is invalid, Handle panics.
+// or the pattern is invalid, Handle panics. Any options
+// are applied to the route.
 //
 // It returns the parsed pattern, suitable for recreating the path.
-func (r *Router) Handle(method, pattern string, handler Handler) *Pattern {
-	pat, err := ParsePattern(pattern)
+func (r *Router) Handle(method, pattern string, handler Handler, opts ...RouteOption) *Pattern {
+	pat, err := r.handle(nil, []string{method}, pattern, handlerEntry{handler: handler}, opts)
 	if err != nil {
-		panic(errgo.Newf("cannot parse pattern %q: %v", pattern, err))
+		panic(err)
 	}
-	r.root.addRoute(pat, method, handler)
-	if len(pat.Keys()) > r.maxParams {
-		r.maxParams = len(pat.Keys())
+	return pat
+}
+
+// HandleError is like Handle except that it returns an error
+// instead of panicking when the route cannot be registered,
+// in which case the router is left unchanged.
+func (r *Router) HandleError(method, pattern string, handler Handler, opts ...RouteOption) (*Pattern, error) {
+	return r.handle(nil, []string{method}, pattern, handlerEntry{handler: handler}, opts)
+}
+
+// Route describes a route to be registered with Router.Add.
+type Route struct {
+	// Method holds the method to register the route for.
+	Method string
+
+	// Pattern holds the route's pattern.
+	Pattern string
+
+	// Handler holds the handler for the route.
+	Handler Handler
+
+	// Options holds any options to apply to the route.
+	Options []RouteOption
+}
+
+// Add registers all the given routes as HandleError does. It returns
+// the parsed pattern for each route, or nil for a route that could
+// not be registered, and an error that joins the errors from all such
+// routes, each annotated with the route's index in routes. The
+// errors remain available to errors.Is and errors.As, so a
+// *PatternError can be used to report where a pattern is invalid.
+func (r *Router) Add(routes []Route) ([]*Pattern, error) {
+	pats := make([]*Pattern, len(routes))
+	var errs []error
+	for i, rt := range routes {
+		pat, err := r.HandleError(rt.Method, rt.Pattern, rt.Handler, rt.Options...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %d (%s %q): %w", i, rt.Method, rt.Pattern, err))
+			continue
+		}
+		pats[i] = pat
+	}
+	return pats, errors.Join(errs...)
+}
+
+// Handles is like Handle except that it registers the handler
+// for each of the given methods. It panics if a method
+// is listed more than once. If the route cannot be registered
+// for any of the methods, it is registered for none of them.
+func (r *Router) Handles(methods []string, pattern string, handler Handler, opts ...RouteOption) *Pattern {
+	pat, err := r.handle(nil, methods, pattern, handlerEntry{handler: handler}, opts)
+	if err != nil {
+		panic(err)
 	}
 	return pat
 }
 
+// handle implements Handle by registering the entry e, which
+// holds the handler, for all the given methods in the tree rooted
+// at root, or in the router's main tree if root is nil.
+func (r *Router) handle(root *node, methods []string, pattern string, e handlerEntry, opts []RouteOption) (*Pattern, error) {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	return r.handleLocked(root, methods, pattern, e, opts)
+}
+
+// handleLocked implements handle. If dynamic routes are
+// enabled, the caller must hold r.dynamic.mu.
+func (r *Router) handleLocked(root *node, methods []string, pattern string, e handlerEntry, opts []RouteOption) (*Pattern, error) {
+	if r.frozen {
+		return nil, errgo.Newf("cannot register %s %q on frozen router", strings.Join(methods, ","), pattern)
+	}
+	pat, err := r.parsePattern(pattern)
+	if err != nil {
+		// Wrap the error so that callers of HandleError
+		// can inspect the *PatternError.
+		return nil, fmt.Errorf("cannot parse pattern %q: %w", pattern, err)
+	}
+	normMethods := make([]string, len(methods))
+	for i, method := range methods {
+		normMethods[i] = r.normalizeMethod(method)
+		for _, m := range normMethods[:i] {
+			if m == normMethods[i] {
+				return nil, errgo.Newf("duplicate method %q in methods for %q", method, pattern)
+			}
+		}
+	}
+	e.pattern = pat
+	for _, opt := range opts {
+		opt(&e.opts)
+	}
+	if e.opts.Name != "" {
+		if _, ok := r.named[e.opts.Name]; ok {
+			return nil, errgo.Newf("duplicate route name %q", e.opts.Name)
+		}
+	}
+	// Check the route for every method before adding any of
+	// them, so that a route that cannot be registered leaves
+	// the tree unchanged.
+	check := root
+	if check == nil {
+		check = r.tree()
+	}
+	for _, method := range normMethods {
+		e.method = method
+		if err := check.checkRoute(pat, &e); err != nil {
+			return nil, err
+		}
+	}
+	add := func(root *node) {
+		for _, method := range normMethods {
+			e.method = method
+			root.addRoute(pat, e)
+		}
+	}
+	if err := catchPanic(func() {
+		if root != nil {
+			add(root)
+		} else {
+			r.updateTree(add)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if e.opts.Name != "" {
+		if r.named == nil {
+			r.named = make(map[string]*Pattern)
+		}
+		r.named[e.opts.Name] = pat
+	}
+	return pat, nil
+}
+
+// catchPanic calls f and returns any value that it panics
+// with as an error. The tree code panics when a route
+// conflicts with an existing one.
+func catchPanic(f func()) (err error) {
+	defer func() {
+		rcv := recover()
+		if rcv == nil {
+			return
+		}
+		if rcvErr, ok := rcv.(error); ok {
+			err = rcvErr
+		} else {
+			err = errgo.Newf("%v", rcv)
+		}
+	}()
+	f()
+	return nil
+}
+
+// Remove removes the route registered for the given method and
+// pattern, reporting whether any route was removed. Routes
+// registered for other methods on the same pattern are left
+// intact; to remove a route registered with HandleAny, use the
+// "*" method. The removed route can no longer be reversed with
+// URL or URLLocalized.
+func (r *Router) Remove(method, pattern string) bool {
+	return r.remove(method, pattern, false)
+}
+
+// RemoveAround removes the middleware registered with HandleAround
+// for the given method and pattern, reporting whether any was
+// removed. Routes registered on the same pattern are left intact.
+func (r *Router) RemoveAround(method, pattern string) bool {
+	return r.remove(method, pattern, true)
+}
+
+// remove implements Remove and RemoveAround.
+func (r *Router) remove(method, pattern string, around bool) bool {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	if r.frozen {
+		panic(errgo.Newf("cannot remove %s %q from frozen router", method, pattern))
+	}
+	pat, err := r.parsePattern(pattern)
+	if err != nil {
+		return false
+	}
+	var removed []handlerEntry
+	r.updateTree(func(root *node) {
+		removed = root.removeRoute(pat, r.normalizeMethod(method), around)
+	})
+	if len(removed) == 0 {
+		return false
+	}
+	for _, e := range removed {
+		if e.opts.Name != "" && r.named[e.opts.Name] == e.pattern {
+			delete(r.named, e.opts.Name)
+		}
+		r.removeLocalized(e.pattern)
+	}
+	return true
+}
+
+// removeLocalized removes pat from the localized routes
+// so that URLLocalized no longer returns paths for it.
+func (r *Router) removeLocalized(pat *Pattern) {
+	for name, pats := range r.localized {
+		for locale, p := range pats {
+			if p == pat {
+				delete(pats, locale)
+			}
+		}
+		if len(pats) == 0 {
+			delete(r.localized, name)
+		}
+	}
+}
+
+// EnableDynamicRoutes makes it safe to call Handle, Handles and Remove
+// while requests are being served. Each change is made to a copy of
+// the routing tree, which then atomically replaces the tree used to
+// serve requests, so lookups never need to take a lock. This makes
+// registering routes slower, in proportion to the number of routes
+// already registered. Routes registered with Router.Host are not
+// covered.
+//
+// EnableDynamicRoutes must be called before any requests are served.
+func (r *Router) EnableDynamicRoutes() {
+	if r.dynamic != nil {
+		return
+	}
+	r.dynamic = new(dynamicTree)
+	r.dynamic.root.Store(r.root)
+	r.root = nil
+}
+
+// dynamicTree holds the routing tree of a router
+// with dynamic routes enabled.
+type dynamicTree struct {
+	// mu guards changes to the tree and to the
+	// router's named routes.
+	mu sync.Mutex
+
+	// root holds the current root of the tree.
+	// The tree it refers to is never changed.
+	root atomic.Pointer[node]
+}
+
+// tree returns the root of the router's main routing tree.
+func (r *Router) tree() *node {
+	if r.dynamic != nil {
+		return r.dynamic.root.Load()
+	}
+	return r.root
+}
+
+// updateTree calls f to modify the router's main routing tree.
+// If dynamic routes are enabled, f is called on a copy of the
+// tree, which replaces the original only if f returns normally.
+// The caller must hold r.dynamic.mu in that case.
+func (r *Router) updateTree(f func(root *node)) {
+	if r.dynamic == nil {
+		f(r.root)
+		return
+	}
+	root := r.dynamic.root.Load().clone()
+	f(root)
+	r.dynamic.root.Store(root)
+}
+
+// Use registers middleware to be applied to every handler the router
+// dispatches to, including fallback handlers such as r.NotFound. The
+// middleware is applied when each request is served, so it sees
+// the parameters for the route. Middleware registered earlier wraps
+// middleware registered later.
+//
+// The middleware runs once for each request. If a route's handler
+// passes (see ErrPass), the middleware also wraps the routes tried
+// after it, but it sees only the parameters of the first route.
+func (r *Router) Use(mw ...func(Handler) Handler) {
+	if r.frozen {
+		panic(errgo.Newf("cannot add middleware to frozen router"))
+	}
+	r.middleware = append(r.middleware, mw...)
+}
+
+// prefixHandler holds a handler registered for a path prefix.
+type prefixHandler struct {
+	prefix  string
+	handler Handler
+}
+
+// NotFoundFor registers h to be used instead of r.NotFound
+// and r.NotFoundByMethod when no route matches a path that
+// is the given prefix or that starts with it followed by a
+// slash; "/api" covers "/api" and "/api/users" but not
+// "/apis". When several prefixes cover a path, the longest
+// one wins. Registering a prefix again replaces its handler.
+func (r *Router) NotFoundFor(prefix string, h Handler) {
+	if r.frozen {
+		panic(errgo.Newf("cannot add not-found handler to frozen router"))
+	}
+	prefix = swapSeparator(prefix, r.Separator)
+	for i, ph := range r.notFoundFor {
+		if ph.prefix == prefix {
+			r.notFoundFor[i].handler = h
+			return
+		}
+	}
+	i := sort.Search(len(r.notFoundFor), func(i int) bool {
+		return len(r.notFoundFor[i].prefix) < len(prefix)
+	})
+	r.notFoundFor = append(r.notFoundFor, prefixHandler{})
+	copy(r.notFoundFor[i+1:], r.notFoundFor[i:])
+	r.notFoundFor[i] = prefixHandler{prefix, h}
+}
+
+// HandleAround registers middleware that wraps the handler of
+// whichever route is chosen for a request that matches the given
+// pattern with the given method, or with any method if method is
+// "*". Unlike a route registered with HandleAny, it does not
+// serve requests itself, so it applies even when a route has
+// been registered for the specific method. Only routes registered
+// with an equivalent pattern are wrapped; for example, a request
+// that falls back to a catch-all route is not. Middleware
+// registered earlier wraps middleware registered later.
+// Registering middleware does not change which route matches
+// a request. It can be removed with RemoveAround.
+//
+// It returns the parsed pattern. Like Handle, it panics if the
+// pattern is invalid.
+func (r *Router) HandleAround(method, pattern string, mw func(Handler) Handler) *Pattern {
+	pat, err := r.handle(nil, []string{method}, pattern, handlerEntry{around: mw}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return pat
+}
+
+// HandleAny registers the handler for the given pattern for all
+// methods, by calling Handle with the "*" method. A handler registered
+// for a specific method on the same pattern takes precedence.
+func (r *Router) HandleAny(pattern string, handler Handler, opts ...RouteOption) *Pattern {
+	return r.Handle("*", pattern, handler, opts...)
+}
+
+// HandleFuncAny is a convenience method that calls HandleAny
+// with HandlerFunc(handler).
+func (r *Router) HandleFuncAny(pattern string, handler func(http.ResponseWriter, *http.Request, Params), opts ...RouteOption) *Pattern {
+	return r.HandleAny(pattern, HandlerFunc(handler), opts...)
+}
+
+// Freeze marks the router as read-only. Any subsequent attempt to
+// register or remove a route will panic. Because the routing tree cannot
+// change after Freeze has been called, requests may be served
+// concurrently by a frozen router without further synchronization.
+func (r *Router) Freeze() {
+	r.frozen = true
+}
+
+// Clone returns a copy of the router. Routes subsequently registered
+// or removed on either router do not affect the other. The copy
+// shares handlers, middleware functions and parsed patterns with r,
+// and has the same configuration except that it is not frozen and
+// dynamic routes are not enabled. The NotFoundByMethod and
+// PanicStatus maps are copied too.
+func (r *Router) Clone() *Router {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	r1 := *r
+	r1.root = r.tree().clone()
+	r1.frozen = false
+	r1.dynamic = nil
+	r1.paramsPool = new(sync.Pool)
+	r1.middleware = append([]func(Handler) Handler(nil), r.middleware...)
+	r1.notFoundFor = append([]prefixHandler(nil), r.notFoundFor...)
+	r1.named = maps.Clone(r.named)
+	r1.NotFoundByMethod = maps.Clone(r.NotFoundByMethod)
+	r1.PanicStatus = maps.Clone(r.PanicStatus)
+	if r.localized != nil {
+		r1.localized = make(map[string]map[string]*Pattern, len(r.localized))
+		for name, patterns := range r.localized {
+			r1.localized[name] = maps.Clone(patterns)
+		}
+	}
+	if r.hosts != nil {
+		r1.hosts = make(map[string]*node, len(r.hosts))
+		for host, root := range r.hosts {
+			r1.hosts[host] = root.clone()
+		}
+	}
+	return &r1
+}
+
 // HandleFunc a convenience method that calls Handle with HandlerFunc(handler).
-func (r *Router) HandleFunc(method, pattern string, handler func(http.ResponseWriter, *http.Request, Params)) *Pattern {
-	return r.Handle(method, pattern, HandlerFunc(handler))
+func (r *Router) HandleFunc(method, pattern string, handler func(http.ResponseWriter, *http.Request, Params), opts ...RouteOption) *Pattern {
+	return r.Handle(method, pattern, HandlerFunc(handler), opts...)
+}
+
+// HandlePrefixStrip registers h to serve all methods for all paths
+// under the given prefix. Before h is called, the prefix is stripped
+// from the request URL's path as it is by StripPrefix, so a request
+// for "/debug/pprof/cmdline" to a handler registered with the prefix
+// "/debug/pprof/" would see the path "/cmdline", which suits an
+// inner http.ServeMux. A trailing slash on the prefix is optional.
+// When the router serves a subroute, h sees the path matched by the
+// catch-all parameter instead.
+//
+// Handlers that inspect the full request path, such as pprof.Index
+// from net/http/pprof, should be registered with Handle instead.
+//
+// It returns the pattern that was registered.
+func (r *Router) HandlePrefixStrip(prefix string, h http.Handler) *Pattern {
+	return r.Handle("*", strings.TrimSuffix(prefix, "/")+"/*path", stripPrefix{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		h:      h,
+	})
+}
+
+// StripPrefix returns a handler that serves requests using r after
+// removing the given prefix from the request URL's path. It is
+// intended to be registered on a catch-all route in another router,
+// for example:
+//
+//	api := hroute.New()
+//	api.Handle("GET", "/users/:id", ...)
+//	root.Handle("*", "/api/*path", hroute.StripPrefix("/api", api))
+//
+// Like http.StripPrefix, it also removes the prefix from the URL's
+// RawPath, but unlike http.StripPrefix, the remaining path always
+// starts with a slash: a trailing slash on the prefix is optional and
+// a request for "/api" is routed as "/". HandlePrefixStrip strips
+// prefixes in the same way.
+//
+// The parameters passed to the returned handler come before the
+// parameters of the route in r, so the handler in r sees both. If the
+// path does not start with the prefix, the request is treated as not
+// found by r.
+func StripPrefix(prefix string, r *Router) Handler {
+	return stripPrefix{
+		prefix: strings.TrimSuffix(prefix, "/"),
+		h:      r,
+	}
+}
+
+// stripPrefix implements HandlePrefixStrip and StripPrefix.
+type stripPrefix struct {
+	// prefix holds the prefix without any trailing slash.
+	prefix string
+	h      http.Handler
+}
+
+// ServeRoute implements Handler.ServeRoute by calling h.h with the
+// prefix removed from the request URL's path. If h.h is a *Router,
+// p is passed on to the handler it chooses.
+func (h stripPrefix) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	r, _ := h.h.(*Router)
+	req1 := *req
+	u := *req.URL
+	path, ok := trimPathPrefix(req.URL.Path, h.prefix)
+	switch {
+	case ok:
+		u.Path = path
+		u.RawPath, _ = trimPathPrefix(u.RawPath, h.prefix)
+	case r != nil:
+		r.notFound(r.normalizeMethod(req.Method), swapSeparator(req.URL.Path, r.Separator)).ServeRoute(w, req, Params{})
+		return
+	default:
+		// The route was not matched against the request
+		// URL's path, as happens in a subroute, so use
+		// the value of the catch-all parameter registered
+		// by HandlePrefixStrip.
+		u.Path = p[len(p)-1].Value
+		if !strings.HasPrefix(u.Path, "/") {
+			// The router has CatchAllNoLeadingSlash set.
+			u.Path = "/" + u.Path
+		}
+		u.RawPath = ""
+	}
+	req1.URL = &u
+	if r == nil {
+		h.h.ServeHTTP(w, &req1)
+		return
+	}
+	r.serveHTTP(w, &req1, p)
+}
+
+// trimPathPrefix returns path with the given prefix, which
+// must not end in a slash, removed. It reports false if path does
+// not start with the prefix followed by a slash or the end of
+// the path.
+func trimPathPrefix(path, prefix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	path = path[len(prefix):]
+	switch {
+	case path == "":
+		return "/", true
+	case path[0] == '/':
+		return path, true
+	}
+	return "", false
+}
+
+// HandleLocalized registers the handler for the given method on each
+// of the patterns in patternsByLocale, which maps from locale to
+// pattern. The route can then be reversed for a particular locale with
+// URLLocalized. If the name has already been used to register
+// localized routes, or any of the patterns cannot be registered,
+// HandleLocalized panics.
+func (r *Router) HandleLocalized(name string, patternsByLocale map[string]string, method string, h Handler) {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	if _, ok := r.localized[name]; ok {
+		panic(errgo.Newf("duplicate localized route name %q", name))
+	}
+	locales := make([]string, 0, len(patternsByLocale))
+	for locale := range patternsByLocale {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	pats := make(map[string]*Pattern)
+	for _, locale := range locales {
+		pat, err := r.handleLocked(nil, []string{method}, patternsByLocale[locale], handlerEntry{handler: h}, nil)
+		if err != nil {
+			panic(err)
+		}
+		pats[locale] = pat
+	}
+	if r.localized == nil {
+		r.localized = make(map[string]map[string]*Pattern)
+	}
+	r.localized[name] = pats
+}
+
+// URLLocalized returns the path for the route registered with
+// HandleLocalized under the given name for the given locale. The
+// params argument holds alternating key and value pairs, one for each
+// key in the locale's pattern. Using keys rather than positions means
+// that the same arguments work for all locales even when their
+// patterns order the parameters differently.
+func (r *Router) URLLocalized(name, locale string, params ...string) (string, error) {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	pats, ok := r.localized[name]
+	if !ok {
+		return "", errgo.Newf("no localized route found with name %q", name)
+	}
+	pat, ok := pats[locale]
+	if !ok {
+		return "", errgo.Newf("route %q has no pattern for locale %q", name, locale)
+	}
+	return pat.pathWithKeyVals(params)
+}
+
+// URL returns the path for the route registered with the given
+// name (see WithName). The params argument holds alternating key and
+// value pairs, one for each key in the route's pattern.
+func (r *Router) URL(name string, params ...string) (string, error) {
+	if r.dynamic != nil {
+		r.dynamic.mu.Lock()
+		defer r.dynamic.mu.Unlock()
+	}
+	pat, ok := r.named[name]
+	if !ok {
+		return "", errgo.Newf("no route found with name %q", name)
+	}
+	return pat.pathWithKeyVals(params)
 }
 
 // ServeHTTP implements http.Handler by consulting req.URL.Method
 // and req.URL.Path and calling the registered handler that most closely
 // matches.
+//
+// If r.UseEncodedPath is true, req.URL.EscapedPath() is used instead
+// of req.URL.Path.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.ServeSubroute(w, req, req.URL.Path)
+	r.serveHTTP(w, req, nil)
+}
+
+// serveHTTP implements ServeHTTP. The parameters in outer are
+// passed to the chosen handler before the route's own parameters.
+func (r *Router) serveHTTP(w http.ResponseWriter, req *http.Request, outer Params) {
+	if r.UseEncodedPath {
+		path := req.URL.EscapedPath()
+		if raw := req.URL.RawPath; raw != "" && raw != path && !validEscapedPath(raw) {
+			// EscapedPath silently ignores an invalid RawPath,
+			// so check it here.
+			r.errorHandler(http.StatusBadRequest, BadRequest{}).ServeRoute(w, req, Params{})
+			return
+		}
+		r.serve(w, req, path, true, outer)
+		return
+	}
+	r.serve(w, req, req.URL.Path, false, outer)
 }
 
 // ServeRoute implements Handler by calling ServeSubroute with path
 // set to the value of the last element in p. This allows a Router to be
-// registered directly as a subroute handler for a subpath.
+// registered directly as a subroute handler for a subpath. If the value
+// does not start with the router's separator, as when the parent router
+// has CatchAllNoLeadingSlash set, the separator is added.
 func (r *Router) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
 	val := ""
 	if len(p) > 0 {
 		val = p[len(p)-1].Value
 	}
+	if sep := r.separator(); val == "" || val[0] != sep {
+		val = string(sep) + val
+	}
 	r.ServeSubroute(w, req, val)
 }
 
 // Handler returns the handler to use for the given method and path, the
 // parameters appropriate for passing to the handler, and the pattern
 // associated with the route. If there is no handler found, it returns
-// zero results.
+// zero results. Route options that depend on the request, such as
+// WithMaxContentLength, are not taken into account.
 func (r *Router) Handler(method, path string) (Handler, Params, *Pattern) {
-	h, p, pat, _ := r.root.getValue(method, path, r.maxParams)
-	return h, p, pat
+	method = r.normalizeMethod(method)
+	e, p, _ := r.tree().getValue(method, swapSeparator(path, r.Separator), nil, r.paramsAlloc())
+	if e == nil {
+		return nil, nil, nil
+	}
+	_, p = r.fromTree(nil, e, p)
+	return e.handler, p, e.pattern
+}
+
+// String returns a short summary of the router, holding the number of
+// registered routes, the methods they use and the first few routes.
+// It is intended for debugging.
+func (r *Router) String() string {
+	const maxShown = 3
+	n := 0
+	var shown []string
+	methods := make(map[string]bool)
+	r.Walk(func(method string, pat *Pattern, _ Handler) bool {
+		n++
+		methods[method] = true
+		if len(shown) < maxShown {
+			shown = append(shown, method+" "+pat.String())
+		}
+		return true
+	})
+	methodList := make([]string, 0, len(methods))
+	for m := range methods {
+		methodList = append(methodList, m)
+	}
+	sort.Strings(methodList)
+	if n == 0 {
+		return "hroute.Router{0 routes}"
+	}
+	if n > maxShown {
+		shown = append(shown, "...")
+	}
+	return fmt.Sprintf("hroute.Router{%d routes; methods %s; %s}", n, strings.Join(methodList, ","), strings.Join(shown, ", "))
+}
+
+// LookupResult holds the result of Router.Lookup.
+type LookupResult struct {
+	// Handler holds the handler registered for the route.
+	Handler Handler
+
+	// Params holds the parameters to pass to the handler.
+	Params Params
+
+	// Pattern holds the pattern that the route was registered with.
+	Pattern *Pattern
+
+	// CatchAll reports whether the path was matched by
+	// a catch-all parameter rather than by a more
+	// specific route. It is equivalent to Kind == MatchCatchAll.
+	CatchAll bool
+
+	// Kind holds the kind of route that matched the path.
+	Kind MatchKind
+
+	// Options holds the options that were specified
+	// when the route was registered.
+	Options RouteOptions
+}
+
+// MatchKind describes the kind of route that matched a path.
+type MatchKind int
+
+const (
+	// MatchNone is used when no route matched.
+	MatchNone MatchKind = iota
+
+	// MatchStatic is used when the route has no wildcards.
+	MatchStatic
+
+	// MatchWildcard is used when the route has wildcards
+	// but no catch-all.
+	MatchWildcard
+
+	// MatchCatchAll is used when the path was matched by
+	// a route ending in a catch-all wildcard.
+	MatchCatchAll
+)
+
+var matchKindNames = []string{
+	MatchNone:     "none",
+	MatchStatic:   "static",
+	MatchWildcard: "wildcard",
+	MatchCatchAll: "catch-all",
+}
+
+// String returns a lower-case name for the kind.
+func (k MatchKind) String() string {
+	if k < 0 || int(k) >= len(matchKindNames) {
+		return fmt.Sprintf("MatchKind(%d)", int(k))
+	}
+	return matchKindNames[k]
+}
+
+// kind returns the kind of match made by a route with the pattern p.
+func (p *Pattern) kind() MatchKind {
+	switch {
+	case p.catchAll:
+		return MatchCatchAll
+	case len(p.vars) > 0:
+		return MatchWildcard
+	}
+	return MatchStatic
+}
+
+// Lookup is like Handler except that it returns its results as a
+// LookupResult, which also holds information on how the route was
+// matched. If no handler is found, it returns the zero LookupResult.
+func (r *Router) Lookup(method, path string) LookupResult {
+	method = r.normalizeMethod(method)
+	e, p, _ := r.tree().getValue(method, swapSeparator(path, r.Separator), nil, r.paramsAlloc())
+	if e == nil {
+		return LookupResult{}
+	}
+	_, p = r.fromTree(nil, e, p)
+	return LookupResult{
+		Handler:  e.handler,
+		Params:   p,
+		Pattern:  e.pattern,
+		CatchAll: e.pattern.catchAll,
+		Kind:     e.pattern.kind(),
+		Options:  e.opts,
+	}
+}
+
+// Methods returns the sorted methods for which a route is registered
+// that would match the given path, or nil if there are none. A route
+// registered for all methods with HandleAny is reported as "*". When
+// some methods are served for the path by a catch-all route, as with a
+// pattern "/a/*rest" for the path "/a/", because no more specific
+// route is registered for them, those methods are included too. As
+// with Lookup, routes registered with Router.Host are not considered.
+func (r *Router) Methods(path string) []string {
+	n, _ := r.tree().lookup(swapSeparator(path, r.Separator), r.paramsAlloc())
+	if n == nil {
+		return nil
+	}
+	var methods []string
+	add := func(n *node) {
+		for _, e := range n.handlers {
+			if i := sort.SearchStrings(methods, e.method); i == len(methods) || methods[i] != e.method {
+				methods = append(methods, "")
+				copy(methods[i+1:], methods[i:])
+				methods[i] = e.method
+			}
+		}
+	}
+	add(n)
+	if n.catchAll != nil {
+		add(n.catchAll)
+	}
+	return methods
+}
+
+// Walk calls fn for each route registered with the router, passing
+// it the method, pattern and handler that the route was registered
+// with. If fn returns false, the traversal stops. Routes registered
+// with Router.Host are not included; see Router.Routes.
+func (r *Router) Walk(fn func(method string, pat *Pattern, h Handler) bool) {
+	r.tree().walk(func(e *handlerEntry) bool {
+		return fn(e.method, e.pattern, e.handler)
+	})
+}
+
+// RouteInfo holds information about a registered route.
+type RouteInfo struct {
+	// Host holds the host the route was registered for
+	// with Router.Host, or the empty string if it was
+	// registered directly on the router.
+	Host string
+
+	// Method holds the method the route was registered with.
+	Method string
+
+	// Pattern holds the pattern the route was registered with.
+	Pattern *Pattern
+
+	// Handler holds the route's handler.
+	Handler Handler
+}
+
+// Routes returns all the routes registered with the router,
+// including those registered with Router.Host, sorted by host,
+// then by pattern and then by method.
+func (r *Router) Routes() []RouteInfo {
+	return r.routesUnder("/")
+}
+
+// RoutesUnder is like Routes except that it returns only the routes
+// whose patterns start with the given static prefix, which is
+// compared as text, so "/users" covers "/users/:id" and "/usersearch"
+// alike. As in a pattern, a literal ':' or '*' in the prefix must be
+// escaped with a backslash. It panics if the prefix contains a
+// wildcard.
+func (r *Router) RoutesUnder(prefix string) []RouteInfo {
+	if indexUnescaped(prefix, ":*{") != -1 {
+		panic(errgo.Newf("route prefix %q contains a wildcard", prefix))
+	}
+	return r.routesUnder(swapSeparator(unescapeStatic(prefix), r.Separator))
+}
+
+// routesUnder implements RoutesUnder for a prefix
+// that uses '/' as the separator.
+func (r *Router) routesUnder(prefix string) []RouteInfo {
+	var routes []RouteInfo
+	add := func(host string, root *node) {
+		n := root.prefixNode(prefix)
+		if n == nil {
+			return
+		}
+		n.walk(func(e *handlerEntry) bool {
+			routes = append(routes, RouteInfo{
+				Host:    host,
+				Method:  e.method,
+				Pattern: e.pattern,
+				Handler: e.handler,
+			})
+			return true
+		})
+	}
+	add("", r.tree())
+	for host, root := range r.hosts {
+		add(host, root)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Host != routes[j].Host {
+			return routes[i].Host < routes[j].Host
+		}
+		pi, pj := routes[i].Pattern.String(), routes[j].Pattern.String()
+		if pi != pj {
+			return pi < pj
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// Stats holds statistics about the routes registered with a
+// router and the shape of the tree used to match them.
+type Stats struct {
+	// Routes holds the number of registered routes, counting
+	// a route once for each of its methods.
+	Routes int
+
+	// Nodes holds the number of nodes in the routing trees.
+	Nodes int
+
+	// MaxDepth holds the number of nodes on the longest path
+	// from the root of a routing tree to any node in it.
+	MaxDepth int
+
+	// MaxParams holds the largest number of parameters
+	// that any route can produce.
+	MaxParams int
+}
+
+// Stats returns statistics about the routes registered with
+// the router, including those registered with Router.Host.
+// It walks the whole tree, so it is intended for tests and
+// diagnostics rather than for use when serving requests.
+func (r *Router) Stats() Stats {
+	var stats Stats
+	r.tree().addStats(&stats, 1)
+	for _, root := range r.hosts {
+		root.addStats(&stats, 1)
+	}
+	return stats
 }
 
 // ServeSubroute is like ServeHTTP except that instead of using
@@ -180,58 +1457,528 @@ func (r *Router) Handler(method, path string) (Handler, Params, *Pattern) {
 // This is useful when the router is being used to serve a subtree
 // but it is desired to keep the request URL intact.
 func (r *Router) ServeSubroute(w http.ResponseWriter, req *http.Request, path string) {
-	handler, params, _ := r.HandlerToUse(req.Method, path)
-	if r.Panic != nil {
+	r.serve(w, req, path, false, nil)
+}
+
+// serve implements ServeSubroute. If unescape is true, the path
+// is percent-encoded and the parameter values are decoded after
+// the route has been found. The parameters in outer, if any, are
+// passed to the handler before the route's own parameters.
+func (r *Router) serve(w http.ResponseWriter, req *http.Request, path string, unescape bool, outer Params) {
+	if r.CheckContextCancel && req.Context().Err() != nil {
+		r.errorHandler(http.StatusServiceUnavailable, Canceled{}).ServeRoute(w, req, Params{})
+		return
+	}
+	r.serveOnce(w, req, path, unescape, outer, nil)
+}
+
+// serveOnce serves the request with the best route whose pattern
+// is not in exclude. If the route's handler declines the request
+// with ErrPass, serveOnce is called again with the route's pattern
+// added to exclude. Each pass excludes another pattern, so this
+// must terminate.
+//
+// The router's middleware is applied only when exclude is empty,
+// so that it wraps all the routes that are tried and runs once for
+// the request.
+func (r *Router) serveOnce(w http.ResponseWriter, req *http.Request, path string, unescape bool, outer Params, exclude []*Pattern) {
+	alloc := r.paramsAlloc()
+	alloc.exclude = exclude
+	if r.PoolParams && r.NewParams == nil {
+		buf, _ := r.paramsPool.Get().(*Params)
+		if buf == nil {
+			buf = new(Params)
+		}
+		alloc.buf = buf
+	}
+	handler, params, e, allow := r.handlerToUse(req.Method, path, req, alloc)
+	if alloc.buf != nil {
+		defer r.releaseParams(alloc.buf, params)
+	}
+	if unescape {
+		unescapeParams(params)
+	}
+	if len(outer) > 0 && e != nil {
+		// Copy outer so that the caller's parameters
+		// are never overwritten.
+		params = append(outer[:len(outer):len(outer)], params...)
+	}
+	if allow != "" {
+		w.Header().Set("Allow", allow)
+	}
+	if r.SetContext {
+		req = withRouteContext(req, params, e)
+	}
+	if r.Panic != nil || len(r.PanicStatus) > 0 || r.ErrorHandler != nil {
+		if r.Panic != nil {
+			// Record whether the handler has written
+			// a header so that RecoverHandler can tell.
+			w = &panicResponseWriter{ResponseWriter: w}
+		}
 		defer r.recover(w, req, handler, params)
 	}
-	handler.ServeRoute(w, req, params)
+	eh := entryHandler{
+		r:        r,
+		h:        handler,
+		e:        e,
+		path:     path,
+		unescape: unescape,
+		outer:    outer,
+		exclude:  exclude,
+	}
+	if len(exclude) > 0 || len(r.middleware) == 0 {
+		// Call eh directly to avoid allocating
+		// a Handler for it.
+		eh.ServeRoute(w, req, params)
+		return
+	}
+	var h Handler = eh
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	h.ServeRoute(w, req, params)
+}
+
+// entryHandler serves a request with the handler chosen by
+// serveOnce, applying the options of the route it was registered
+// with. If the handler passes, it tries the next route.
+type entryHandler struct {
+	r        *Router
+	h        Handler
+	e        *handlerEntry
+	path     string
+	unescape bool
+	outer    Params
+	exclude  []*Pattern
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h entryHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	if h.e == nil {
+		h.h.ServeRoute(w, req, p)
+		return
+	}
+	if h.serveEntry(w, req, p) {
+		exclude := append(h.exclude[:len(h.exclude):len(h.exclude)], h.e.pattern)
+		h.r.serveOnce(w, req, h.path, h.unescape, h.outer, exclude)
+	}
+}
+
+// serveEntry serves the request with the route's handler
+// and reports whether the handler passed.
+func (h entryHandler) serveEntry(w http.ResponseWriter, req *http.Request, p Params) (passed bool) {
+	e := h.e
+	if e.method == "GET" && h.r.normalizeMethod(req.Method) == "HEAD" {
+		w = headResponseWriter{w}
+	}
+	if h.r.Gzip || e.opts.Gzip {
+		addVaryAcceptEncoding(w.Header())
+		if acceptsGzip(req) {
+			gw := newGzipResponseWriter(w)
+			defer gw.Close()
+			w = gw
+		}
+	}
+	if e.opts.PreHandler != nil && !e.opts.PreHandler(w, req, p) {
+		return false
+	}
+	handler := h.h
+	for i := len(e.opts.Middleware) - 1; i >= 0; i-- {
+		handler = e.opts.Middleware[i](handler)
+	}
+	return serveRoute(handler, w, req, p)
+}
+
+// serveRoute calls h.ServeRoute and reports whether
+// the handler declined the request by panicking
+// with ErrPass.
+func serveRoute(h Handler, w http.ResponseWriter, req *http.Request, p Params) (passed bool) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if rcv != ErrPass {
+				panic(rcv)
+			}
+			passed = true
+		}
+	}()
+	h.ServeRoute(w, req, p)
+	return false
+}
+
+// releaseParams returns buf to the pool after the
+// parameters p allocated from it are no longer in use.
+func (r *Router) releaseParams(buf *Params, p Params) {
+	if cap(p) > cap(*buf) {
+		// The parameters were grown beyond the buffer,
+		// so keep the larger one.
+		*buf = p
+	}
+	// Clear the values so that they can be garbage collected.
+	p = (*buf)[:cap(*buf)]
+	for i := range p {
+		p[i] = Param{}
+	}
+	*buf = (*buf)[:0]
+	r.paramsPool.Put(buf)
 }
 
 func (r *Router) recover(w http.ResponseWriter, req *http.Request, h Handler, p Params) {
-	if rcv := recover(); rcv != nil {
+	rcv := recover()
+	if rcv == nil {
+		return
+	}
+	status, ok := r.PanicStatus[reflect.TypeOf(rcv)]
+	switch {
+	case ok && r.ErrorHandler != nil:
+		r.ErrorHandler(w, req, status, p)
+	case ok:
+		http.Error(w, http.StatusText(status), status)
+	case r.ErrorHandler != nil:
+		r.ErrorHandler(w, req, http.StatusInternalServerError, p)
+	case r.Panic != nil:
 		r.Panic(w, req, h, p, rcv)
+	default:
+		panic(rcv)
 	}
 }
 
 // HandlerToUse returns the handler that will be used to handle a
 // request with the given method and path. It never returns a nil
 // handler. If a handler has not been registered with the given path,
-// one of r.NotFound, r.MethodNotAllowed or a value of type Redirect
-// will be returned. If a handler was registered, the returned pattern
-// will hold the pattern it was registered with.
+// one of r.NotFound, r.NotFoundByMethod[method], r.MethodNotAllowed or
+// a value of type Redirect will be returned. If the path is longer than r.MaxPathLength
+// or has more than r.MaxSegments segments, RequestURITooLong{} will be returned. If r.ErrorHandler is set, it
+// is used instead of r.NotFound, r.MethodNotAllowed and
+// RequestURITooLong{}. If a handler was registered,
+// the returned pattern will hold the pattern it was registered with.
 func (r *Router) HandlerToUse(method, path string) (Handler, Params, *Pattern) {
-	h, p, pat, node := r.root.getValue(method, path, r.maxParams)
-	if h != nil {
-		return h, p, pat
+	h, p, e, _ := r.handlerToUse(method, path, nil, r.paramsAlloc())
+	if e == nil {
+		return h, p, nil
+	}
+	return h, p, e.pattern
+}
+
+// Explanation describes how a router would serve a request.
+// See Router.Explain.
+type Explanation struct {
+	// Handler holds the handler that would serve the request.
+	// This may be one of the router's fallback handlers,
+	// such as r.NotFound, or a Redirect.
+	Handler Handler
+
+	// Params holds the parameters that would be passed
+	// to the handler.
+	Params Params
+
+	// Pattern holds the pattern of the matched route,
+	// or nil if no route was matched.
+	Pattern *Pattern
+
+	// Options holds the options that were specified
+	// when the matched route was registered.
+	Options RouteOptions
+}
+
+// Explain describes how a request with the given method and path would
+// be served, without calling any handler. As with HandlerToUse, route
+// options that depend on the request are not taken into account.
+func (r *Router) Explain(method, path string) Explanation {
+	h, p, e, _ := r.handlerToUse(method, path, nil, r.paramsAlloc())
+	if e == nil {
+		return Explanation{
+			Handler: h,
+			Params:  p,
+		}
+	}
+	return Explanation{
+		Handler: h,
+		Params:  p,
+		Pattern: e.pattern,
+		Options: e.opts,
+	}
+}
+
+// handlerToUse is like HandlerToUse except that it returns
+// the handler entry that was matched rather than its pattern.
+// The entry is nil if no registered handler was found.
+// If req is non-nil, it is used to select between entries
+// with request-dependent route options. Any parameters
+// are allocated with alloc.
+//
+// When the method is not allowed for the path, it also returns
+// the value to use for the Allow header in the response.
+func (r *Router) handlerToUse(method, path string, req *http.Request, alloc paramsAlloc) (_ Handler, _ Params, _ *handlerEntry, allow string) {
+	if (r.Separator == 0 || r.Separator == '/') && !r.CatchAllNoLeadingSlash {
+		return r.treeHandlerToUse(method, path, req, alloc)
+	}
+	h, p, e, allow := r.treeHandlerToUse(method, swapSeparator(path, r.Separator), req, alloc)
+	h, p = r.fromTree(h, e, p)
+	return h, p, e, allow
+}
+
+// treeHandlerToUse implements handlerToUse for a path
+// that uses '/' as the separator.
+func (r *Router) treeHandlerToUse(method, path string, req *http.Request, alloc paramsAlloc) (_ Handler, _ Params, _ *handlerEntry, allow string) {
+	if r.tooLong(path) {
+		return r.errorHandler(http.StatusRequestURITooLong, RequestURITooLong{}), Params{}, nil, ""
+	}
+	method = r.normalizeMethod(method)
+	if req != nil && len(r.hosts) > 0 {
+		if root := r.hosts[hostName(req.Host)]; root != nil {
+			if e, p, _ := root.getValue(method, path, req, alloc); e != nil {
+				return e.handler, p, e, ""
+			}
+		}
+	}
+	e, p, node := r.tree().getValue(method, path, req, alloc)
+	if e != nil {
+		return e.handler, p, e, ""
+	}
+	if method == "HEAD" && r.AutoHead {
+		if e, p, _ := r.tree().getValue("GET", path, req, alloc); e != nil {
+			return e.handler, p, e, ""
+		}
+	}
+	if len(alloc.exclude) > 0 {
+		// Every route that could serve the request has
+		// declined it.
+		return r.notFound(method, path), Params{}, nil, ""
 	}
 	if node != nil && len(node.handlers) > 0 {
 		// There is at least one other handler defined for this path,
 		// so don't redirect.
-		return r.MethodNotAllowed, Params{}, nil
+		if req != nil && node.entryForMethod(method, nil, nil) != nil {
+			// There is a route for the method, but its
+			// content length limit excludes the request.
+			return r.errorHandler(http.StatusRequestEntityTooLarge, RequestEntityTooLarge{}), Params{}, nil, ""
+		}
+		extra := ""
+		if r.HandleOPTIONS {
+			extra = "OPTIONS"
+		}
+		allowed := node.allowedMethods(extra)
+		allow := strings.Join(allowed, ", ")
+		if r.HandleOPTIONS && method == "OPTIONS" {
+			return optionsHandler{allow}, Params{}, nil, ""
+		}
+		return r.methodNotAllowed(allowed), Params{}, nil, allow
 	}
 	if method == "CONNECT" || path == "/" {
 		// Can't redirect CONNECT; no need to redirect /.
-		return r.NotFound, Params{}, nil
+		return r.notFound(method, path), Params{}, nil, ""
+	}
+	if target, code := r.redirectTarget(method, path); target != "" {
+		if req != nil && req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		return Redirect{
+			Path: target,
+			Code: code,
+		}, Params{}, nil, ""
+	}
+	return r.notFound(method, path), Params{}, nil, ""
+}
+
+// tooLong reports whether the given path, which uses '/'
+// as the separator, exceeds r.MaxPathLength or r.MaxSegments.
+func (r *Router) tooLong(path string) bool {
+	if r.MaxPathLength > 0 && len(path) > r.MaxPathLength {
+		return true
+	}
+	return r.MaxSegments > 0 && strings.Count(path, "/") > r.MaxSegments
+}
+
+// RedirectTarget reports where a request with the given method and
+// path would be redirected by the router because the path is not
+// clean or because of a trailing slash mismatch. If the request would
+// not be redirected, it returns false.
+func (r *Router) RedirectTarget(method, path string) (target string, code int, ok bool) {
+	path = swapSeparator(path, r.Separator)
+	if r.tooLong(path) {
+		return "", 0, false
+	}
+	method = r.normalizeMethod(method)
+	e, _, node := r.tree().getValue(method, path, nil, r.paramsAlloc())
+	if e != nil || node != nil && len(node.handlers) > 0 {
+		return "", 0, false
+	}
+	if method == "CONNECT" || path == "/" {
+		return "", 0, false
+	}
+	target, code = r.redirectTarget(method, path)
+	return swapSeparator(target, r.Separator), code, target != ""
+}
+
+// redirectTarget returns the path and status code to redirect
+// to for a request that has not matched any route.
+// It returns an empty path if there should be no redirect.
+func (r *Router) redirectTarget(method, path string) (string, int) {
+	if r.DisableRedirects {
+		return "", 0
 	}
 	code := http.StatusMovedPermanently // Permanent redirect, request with GET method
+	if r.RedirectCode != 0 {
+		code = r.RedirectCode
+	}
 	if method != "GET" {
 		// Temporary redirect, request with same method
-		// TODO use StatusPermanentRedirect ?
 		code = http.StatusTemporaryRedirect
+		if r.NonGETRedirectCode != 0 {
+			code = r.NonGETRedirectCode
+		}
 	}
-	if cleanPath := CleanPath(path); cleanPath != path {
-		return Redirect{
-			Path: cleanPath,
-			Code: code,
-		}, Params{}, nil
+	if r.RedirectCleanPath && !r.AssumeCleanPath {
+		if cleanPath := CleanPath(path); cleanPath != path {
+			if r.CleanPathRedirectCode != 0 {
+				code = r.CleanPathRedirectCode
+			}
+			return cleanPath, code
+		}
 	}
-	if redirectPath := r.slashRedirect(method, path); redirectPath != "" {
-		return Redirect{
-			Path: redirectPath,
-			Code: code,
-		}, Params{}, nil
+	if r.RedirectTrailingSlash {
+		if redirectPath := r.slashRedirect(method, path); redirectPath != "" {
+			return redirectPath, code
+		}
+	}
+	if r.RedirectFixedPath {
+		if fixedPath, ok := r.tree().findCaseInsensitivePath(path, r.RedirectTrailingSlash); ok && !r.strictSlash(method, path, fixedPath) {
+			return fixedPath, code
+		}
+	}
+	return "", 0
+}
+
+// notFound returns the handler to use when no route can be
+// found for a request with the given method and path, which
+// uses '/' as the separator.
+func (r *Router) notFound(method, path string) Handler {
+	for _, ph := range r.notFoundFor {
+		if rest, ok := strings.CutPrefix(path, ph.prefix); ok && (rest == "" || rest[0] == '/' || strings.HasSuffix(ph.prefix, "/")) {
+			return ph.handler
+		}
+	}
+	if h := r.NotFoundByMethod[method]; h != nil {
+		return h
+	}
+	h := r.NotFound
+	if h == nil {
+		h = NotFound{}
+	}
+	return r.errorHandler(http.StatusNotFound, h)
+}
+
+// methodNotAllowed returns the handler to use when the method is not
+// allowed for a path that has handlers for the given methods.
+func (r *Router) methodNotAllowed(allowed []string) Handler {
+	h := r.MethodNotAllowed
+	if h == nil {
+		h = MethodNotAllowed{}
+	}
+	if h1, ok := h.(MethodNotAllowedHandler); ok {
+		h = methodNotAllowedHandler{
+			h:       h1,
+			allowed: allowed,
+		}
+	}
+	return r.errorHandler(http.StatusMethodNotAllowed, h)
+}
+
+// methodNotAllowedHandler is the handler used to call
+// MethodNotAllowedHandler.ServeMethodNotAllowed.
+type methodNotAllowedHandler struct {
+	h       MethodNotAllowedHandler
+	allowed []string
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h methodNotAllowedHandler) ServeRoute(w http.ResponseWriter, req *http.Request, _ Params) {
+	h.h.ServeMethodNotAllowed(w, req, h.allowed)
+}
+
+// errorHandler returns the handler to use for an error response with
+// the given status. This is h unless r.ErrorHandler is set.
+func (r *Router) errorHandler(status int, h Handler) Handler {
+	if r.ErrorHandler == nil {
+		return h
+	}
+	return statusHandler{
+		f:      r.ErrorHandler,
+		status: status,
 	}
-	return r.NotFound, Params{}, nil
+}
+
+// statusHandler is the handler used to call Router.ErrorHandler.
+type statusHandler struct {
+	f      func(w http.ResponseWriter, req *http.Request, status int, p Params)
+	status int
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h statusHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	h.f(w, req, h.status, p)
+}
+
+// optionsHandler is the handler used to respond to OPTIONS
+// requests when Router.HandleOPTIONS is set.
+type optionsHandler struct {
+	allow string
+}
+
+// ServeRoute implements Handler.ServeRoute.
+func (h optionsHandler) ServeRoute(w http.ResponseWriter, req *http.Request, p Params) {
+	w.Header().Set("Allow", h.allow)
+	w.WriteHeader(http.StatusOK)
+}
+
+// headResponseWriter is used to discard the body written
+// by a GET handler serving a HEAD request.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Write implements http.ResponseWriter.Write by
+// discarding the data.
+func (w headResponseWriter) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+// unescapeParams replaces the value of each parameter in ps
+// with its percent-decoded form. The values come from
+// req.URL.EscapedPath, which is always validly encoded.
+func unescapeParams(ps Params) {
+	for i := range ps {
+		if strings.IndexByte(ps[i].Value, '%') == -1 {
+			continue
+		}
+		if v, err := url.PathUnescape(ps[i].Value); err == nil {
+			ps[i].Value = v
+		}
+	}
+}
+
+// validEscapedPath reports whether p is a validly
+// percent-encoded path.
+func validEscapedPath(p string) bool {
+	_, err := url.PathUnescape(p)
+	return err == nil
+}
+
+// paramsAlloc returns the allocator to use
+// for the parameters of a lookup.
+func (r *Router) paramsAlloc() paramsAlloc {
+	return paramsAlloc{
+		new: r.NewParams,
+	}
+}
+
+// normalizeMethod returns the method as it should
+// be stored in or looked up from the tree.
+func (r *Router) normalizeMethod(method string) string {
+	if r.NormalizeMethod {
+		return strings.ToUpper(method)
+	}
+	return method
 }
 
 // slashRedirect returns a possible redirected path when the
@@ -242,12 +1989,28 @@ func (r *Router) slashRedirect(method, path string) string {
 	} else {
 		path += "/"
 	}
-	n, _ := r.root.lookup(path, r.maxParams)
+	n, _ := r.tree().lookup(path, r.paramsAlloc())
 	if n == nil {
 		return ""
 	}
-	if n.entryForMethod(method) == nil {
+	if e := n.entryForMethod(method, nil, nil); e == nil || e.opts.StrictSlash {
 		return ""
 	}
 	return path
 }
+
+// strictSlash reports whether the redirect from path to the
+// case-corrected fixedPath adds or removes a trailing slash
+// and the route that fixedPath matches has asked not to be
+// redirected to in that way.
+func (r *Router) strictSlash(method, path, fixedPath string) bool {
+	if strings.HasSuffix(path, "/") == strings.HasSuffix(fixedPath, "/") {
+		return false
+	}
+	n, _ := r.tree().lookup(fixedPath, r.paramsAlloc())
+	if n == nil {
+		return false
+	}
+	e := n.entryForMethod(method, nil, nil)
+	return e != nil && e.opts.StrictSlash
+}
@@ -1,10 +1,15 @@
 package hroute_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp/syntax"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/rogpeppe/hroute"
@@ -35,6 +40,102 @@ var parsePatternTests = []struct {
 	path:       "/a/b/:x/c/d",
 	expectKeys: []string{"x"},
 	expectPath: "/a/b/0/c/d",
+}, {
+	path:       "/a/**mid/z",
+	expectKeys: []string{"mid"},
+	expectPath: "/a/0/z",
+}, {
+	path:        "/a/**mid",
+	expectError: "multi-segment wildcard not followed by static segment",
+}, {
+	path:        "/a/*mid/z",
+	expectError: "catch-all route not at end of path",
+}, {
+	path:       `/user/:id(\d+)/info`,
+	expectKeys: []string{"id"},
+	expectPath: "/user/0/info",
+}, {
+	path:            `/file/:name(.+\.txt)`,
+	expectKeys:      []string{"name"},
+	expectPathError: `parameter "name" does not match constraint`,
+}, {
+	path:        `/user/:id(\d+`,
+	expectError: "unterminated constraint",
+}, {
+	path:        `/user/:id([)`,
+	expectError: "invalid constraint for \"id\": error parsing regexp: missing closing ]: `[)$`",
+}, {
+	path:        "/a/*rest(x)",
+	expectError: "constraint not allowed on catch-all wildcard",
+}, {
+	path:       `/:ver(v(\d+))`,
+	expectKeys: []string{"ver"},
+}, {
+	path:        `/files/:name.:ext(\w+)`,
+	expectError: "constraint not allowed in segment with static text or several wildcards",
+}, {
+	path:        `/a/:x\:y(\d+)`,
+	expectError: "constraint not allowed in segment with static text or several wildcards",
+}, {
+	path:       "/files/:name.:ext",
+	expectKeys: []string{"name", "ext"},
+	expectPath: "/files/0.1",
+}, {
+	path:       "/v/:major-:minor.json/info",
+	expectKeys: []string{"major", "minor"},
+	expectPath: "/v/0-1.json/info",
+}, {
+	path:        "/a/:x:y",
+	expectError: "wildcards in segment not separated by static text",
+}, {
+	path:        "/a/:x-:",
+	expectError: "invalid wildcard name in segment",
+}, {
+	path:       "/users/:id{/}",
+	expectKeys: []string{"id"},
+	expectPath: "/users/0",
+}, {
+	path:       "/about{/}",
+	expectPath: "/about",
+}, {
+	path:        "/about/{/}",
+	expectError: "{/} must not follow a slash or a catch-all wildcard",
+}, {
+	path:        "/files/*rest{/}",
+	expectError: "{/} must not follow a slash or a catch-all wildcard",
+}, {
+	path:       `/search/:q(\w+)?`,
+	expectKeys: []string{"q"},
+	expectPath: "/search/0",
+}, {
+	path:        "/search/:q?/more",
+	expectError: "optional wildcard must be the whole of the final segment",
+}, {
+	path:        "/files/:name.:ext?",
+	expectError: "optional wildcard must be the whole of the final segment",
+}, {
+	path:       `/emoji/\:)`,
+	expectPath: "/emoji/:)",
+}, {
+	path:       `/geo/\:lat,\:lng`,
+	expectPath: "/geo/:lat,:lng",
+}, {
+	path:       `/glob/\*.txt`,
+	expectPath: "/glob/*.txt",
+}, {
+	path:       `/a/:x\:y`,
+	expectKeys: []string{"x"},
+	expectPath: "/a/0:y",
+}, {
+	path:       `/a/:x.:y\:z`,
+	expectKeys: []string{"x", "y"},
+	expectPath: "/a/0.1:z",
+}, {
+	path:       `/a/\\:x`,
+	expectPath: `/a/\:x`,
+}, {
+	path:        `/a\:b:c`,
+	expectError: "no / before wildcard segment",
 }}
 
 func TestParsePattern(t *testing.T) {
@@ -80,6 +181,222 @@ func TestParsePattern(t *testing.T) {
 	}
 }
 
+func TestPatternEqual(t *testing.T) {
+	mustParse := func(s string) *hroute.Pattern {
+		pat, err := hroute.ParsePattern(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pat
+	}
+	for _, test := range []struct {
+		p1, p2      *hroute.Pattern
+		expectEqual bool
+	}{
+		{mustParse("/a/:x"), mustParse("/a/:x"), true},
+		{mustParse("/a/:x"), mustParse("/a/:y"), false},
+		{mustParse(`/a/:x(\d+)`), mustParse(`/a/:x(\d+)`), true},
+		{mustParse(`/a/:x(\d+)`), mustParse("/a/:x"), false},
+		{mustParse("/a/*rest"), mustParse("/a/**rest/b"), false},
+		{mustParse("/a{/}"), mustParse("/a"), false},
+		{mustParse("/a"), nil, false},
+		{nil, nil, true},
+	} {
+		if got := test.p1.Equal(test.p2); got != test.expectEqual {
+			t.Errorf("%v.Equal(%v): got %v want %v", test.p1, test.p2, got, test.expectEqual)
+		}
+	}
+}
+
+func TestPatternMatches(t *testing.T) {
+	for _, test := range []struct {
+		pattern      string
+		path         string
+		expectMatch  bool
+		expectParams hroute.Params
+	}{{
+		pattern:     "/a/b",
+		path:        "/a/b",
+		expectMatch: true,
+	}, {
+		pattern: "/a/b",
+		path:    "/a/b/",
+	}, {
+		pattern:      "/users/:id/posts",
+		path:         "/users/42/posts",
+		expectMatch:  true,
+		expectParams: hroute.Params{{"id", "42"}},
+	}, {
+		pattern: `/users/:id(\d+)`,
+		path:    "/users/bob",
+	}, {
+		pattern:      "/files/*path",
+		path:         "/files/a/b",
+		expectMatch:  true,
+		expectParams: hroute.Params{{"path", "/a/b"}},
+	}, {
+		pattern:      "/search/:q?",
+		path:         "/search",
+		expectMatch:  true,
+		expectParams: hroute.Params{{"q", ""}},
+	}, {
+		pattern:      "/x/:id{/}",
+		path:         "/x/1/",
+		expectMatch:  true,
+		expectParams: hroute.Params{{"id", "1"}},
+	}} {
+		pat, err := hroute.ParsePattern(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, ok := pat.Matches(test.path)
+		if ok != test.expectMatch {
+			t.Errorf("%s %s: unexpected match result %v", test.pattern, test.path, ok)
+			continue
+		}
+		if !reflect.DeepEqual(ps, test.expectParams) {
+			t.Errorf("%s %s: unexpected params; got %#v want %#v", test.pattern, test.path, ps, test.expectParams)
+		}
+	}
+}
+
+var patternErrorTests = []struct {
+	pattern      string
+	expectErr    error
+	expectOffset int
+}{{
+	pattern:   "/a/../b",
+	expectErr: hroute.ErrNotClean,
+}, {
+	pattern:      `/files/:name.:ext(\w+)`,
+	expectErr:    hroute.ErrConstraintInSegment,
+	expectOffset: 7,
+}, {
+	pattern:      "/a/b:c",
+	expectErr:    hroute.ErrWildcardNotPreceded,
+	expectOffset: 4,
+}, {
+	pattern:      "/a/*rest/b",
+	expectErr:    hroute.ErrCatchAllNotAtEnd,
+	expectOffset: 3,
+}, {
+	pattern:      "/a/:x/:id([0-9)",
+	expectErr:    hroute.ErrInvalidConstraint,
+	expectOffset: 6,
+}, {
+	pattern:      "/a/:x:y",
+	expectErr:    hroute.ErrAdjacentWildcards,
+	expectOffset: 3,
+}}
+
+func TestOptionalTrailingSlash(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/users/:id{/}", pathHandler{"GET", "/users/:id{/}"})
+	r.Handle("GET", "/about{/}", pathHandler{"GET", "/about{/}"})
+	for _, path := range []string{"/users/42", "/users/42/", "/about", "/about/"} {
+		h, ps, pat := r.HandlerToUse("GET", path)
+		if pat == nil {
+			t.Errorf("no route found for %q; got handler %#v", path, h)
+			continue
+		}
+		if want := (pathHandler{"GET", pat.String()}); h != want {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", path, h, want)
+		}
+		got, err := pat.PathWithParams(ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimSuffix(path, "/"); got != want {
+			t.Errorf("unexpected reverse path for %q; got %q want %q", path, got, want)
+		}
+	}
+	if got, want := len(r.Routes()), 2; got != want {
+		t.Errorf("unexpected route count; got %d want %d", got, want)
+	}
+
+	// Both forms are removed together.
+	if !r.Remove("GET", "/about{/}") {
+		t.Fatalf("route not removed")
+	}
+	for _, path := range []string{"/about", "/about/"} {
+		if _, _, pat := r.HandlerToUse("GET", path); pat != nil {
+			t.Errorf("unexpected route for %q after removal: %v", path, pat)
+		}
+	}
+}
+
+func TestOptionalWildcard(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/search/:q?", pathHandler{"GET", "/search/:q?"})
+	r.Handle("GET", "/a/:x/:y?", pathHandler{"GET", "/a/:x/:y?"})
+	r.Handle("GET", "/:root?", pathHandler{"GET", "/:root?"})
+	for _, test := range []struct {
+		path          string
+		expectPattern string
+		expectParams  hroute.Params
+	}{
+		{"/search/foo", "/search/:q?", hroute.Params{{"q", "foo"}}},
+		{"/search", "/search/:q?", hroute.Params{{"q", ""}}},
+		{"/a/1/2", "/a/:x/:y?", hroute.Params{{"x", "1"}, {"y", "2"}}},
+		{"/a/1", "/a/:x/:y?", hroute.Params{{"x", "1"}, {"y", ""}}},
+		{"/", "/:root?", hroute.Params{{"root", ""}}},
+		{"/top", "/:root?", hroute.Params{{"root", "top"}}},
+	} {
+		h, ps, pat := r.HandlerToUse("GET", test.path)
+		if pat == nil {
+			t.Errorf("no route found for %q; got %#v", test.path, h)
+			continue
+		}
+		if got := pat.String(); got != test.expectPattern {
+			t.Errorf("%q: unexpected pattern; got %q want %q", test.path, got, test.expectPattern)
+		}
+		if !reflect.DeepEqual(ps, test.expectParams) {
+			t.Errorf("%q: unexpected params; got %#v want %#v", test.path, ps, test.expectParams)
+		}
+		got, err := pat.PathWithParams(ps)
+		if err != nil {
+			t.Fatalf("%q: %v", test.path, err)
+		}
+		if got != test.path {
+			t.Errorf("unexpected reverse path; got %q want %q", got, test.path)
+		}
+	}
+	if got, want := len(r.Routes()), 3; got != want {
+		t.Errorf("unexpected route count; got %d want %d", got, want)
+	}
+	if !r.Remove("GET", "/search/:q?") {
+		t.Fatalf("route not removed")
+	}
+	for _, path := range []string{"/search", "/search/foo"} {
+		if _, _, pat := r.HandlerToUse("GET", path); pat != nil && pat.String() == "/search/:q?" {
+			t.Errorf("unexpected route for %q after removal", path)
+		}
+	}
+}
+
+func TestPatternError(t *testing.T) {
+	for _, test := range patternErrorTests {
+		_, err := hroute.ParsePattern(test.pattern)
+		if !errors.Is(err, test.expectErr) {
+			t.Errorf("%q: unexpected error; got %v want %v", test.pattern, err, test.expectErr)
+			continue
+		}
+		var perr *hroute.PatternError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: error %#v is not a *PatternError", test.pattern, err)
+			continue
+		}
+		if perr.Pattern != test.pattern || perr.Offset != test.expectOffset {
+			t.Errorf("%q: unexpected position; got %q at %d want offset %d", test.pattern, perr.Pattern, perr.Offset, test.expectOffset)
+		}
+	}
+	_, err := hroute.ParsePattern("/:id([0-9)")
+	var serr *syntax.Error
+	if !errors.As(err, &serr) {
+		t.Errorf("invalid constraint error does not wrap the regexp error; got %#v", err)
+	}
+}
+
 type lookupTest struct {
 	// path holds the path to be looked up.
 	// By default, it will be looked up with the GET method
@@ -341,6 +658,192 @@ var handlerTests = []struct {
 		path:       "/foo/barfle",
 		matchIndex: 1,
 	}},
+}, {
+	about: "node split below wildcard",
+	add: []string{
+		"/foobar/:x",
+		"/fooqux",
+	},
+	lookups: []lookupTest{{
+		path:          "/foobar/y",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/foobar/:x"},
+		expectParams:  hroute.Params{{"x", "y"}},
+	}, {
+		path:       "/fooqux",
+		matchIndex: 1,
+	}},
+}, {
+	about: "node split at node with wildcard and catch-all",
+	add: []string{
+		"/foo/:x",
+		"/foo/*rest",
+		"/foo/x",
+		"/fo",
+	},
+	lookups: []lookupTest{{
+		path:          "/foo/y",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/foo/:x"},
+		expectParams:  hroute.Params{{"x", "y"}},
+	}, {
+		path:          "/foo/y/z",
+		matchIndex:    1,
+		expectHandler: pathHandler{"GET", "/foo/*rest"},
+		expectParams:  hroute.Params{{"rest", "/y/z"}},
+	}, {
+		path:       "/foo/x",
+		matchIndex: 2,
+	}, {
+		path:       "/fo",
+		matchIndex: 3,
+	}},
+}, {
+	about: "node split at node with handler",
+	add: []string{
+		"/foobar",
+		"/foo",
+		"/f",
+	},
+	lookups: []lookupTest{{
+		path:       "/foobar",
+		matchIndex: 0,
+	}, {
+		path:       "/foo",
+		matchIndex: 1,
+	}, {
+		path:       "/f",
+		matchIndex: 2,
+	}},
+}, {
+	about: "multi-segment wildcard",
+	add: []string{
+		"/a/**mid/z",
+	},
+	lookups: []lookupTest{{
+		path:          "/a/x/y/z",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/a/**mid/z"},
+		expectParams:  hroute.Params{{"mid", "x/y"}},
+	}, {
+		path:          "/a/x/z",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/a/**mid/z"},
+		expectParams:  hroute.Params{{"mid", "x"}},
+	}, {
+		path:          "/a/x/z/z",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/a/**mid/z"},
+		expectParams:  hroute.Params{{"mid", "x/z"}},
+	}, {
+		path:          "/a/z",
+		matchIndex:    -1,
+		expectHandler: hroute.NotFound{},
+	}, {
+		path:          "/a/x/y",
+		matchIndex:    -1,
+		expectHandler: hroute.NotFound{},
+	}},
+}, {
+	about: "single-segment wildcard takes precedence over multi-segment wildcard",
+	add: []string{
+		"/a/**mid/z",
+		"/a/:x/z",
+		"/a/b/*rest",
+	},
+	lookups: []lookupTest{{
+		path:          "/a/x/z",
+		matchIndex:    1,
+		expectHandler: pathHandler{"GET", "/a/:x/z"},
+		expectParams:  hroute.Params{{"x", "x"}},
+	}, {
+		path:          "/a/x/y/z",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/a/**mid/z"},
+		expectParams:  hroute.Params{{"mid", "x/y"}},
+	}, {
+		path:          "/a/b/c",
+		matchIndex:    2,
+		expectHandler: pathHandler{"GET", "/a/b/*rest"},
+		expectParams:  hroute.Params{{"rest", "/c"}},
+	}},
+}, {
+	about: "constrained wildcards take precedence over unconstrained wildcards",
+	add: []string{
+		`/user/:id(\d+)`,
+		"/user/:name",
+		`/file/:name(.+\.txt)`,
+		`/v/:n(\d+)/x`,
+		"/v/:s/y",
+	},
+	lookups: []lookupTest{{
+		path:          "/user/42",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", `/user/:id(\d+)`},
+		expectParams:  hroute.Params{{"id", "42"}},
+	}, {
+		path:          "/user/abc",
+		matchIndex:    1,
+		expectHandler: pathHandler{"GET", "/user/:name"},
+		expectParams:  hroute.Params{{"name", "abc"}},
+	}, {
+		path:          "/file/a.txt",
+		matchIndex:    2,
+		expectHandler: pathHandler{"GET", `/file/:name(.+\.txt)`},
+		expectParams:  hroute.Params{{"name", "a.txt"}},
+	}, {
+		path:          "/file/a.jpg",
+		matchIndex:    -1,
+		expectHandler: hroute.NotFound{},
+	}, {
+		path:          "/v/1/x",
+		matchIndex:    3,
+		expectHandler: pathHandler{"GET", `/v/:n(\d+)/x`},
+		expectParams:  hroute.Params{{"n", "1"}},
+	}, {
+		path:          "/v/1/y",
+		matchIndex:    4,
+		expectHandler: pathHandler{"GET", "/v/:s/y"},
+		expectParams:  hroute.Params{{"s", "1"}},
+	}},
+}, {
+	about: "several wildcards in one segment",
+	add: []string{
+		"/files/:name.:ext",
+		"/files/:name",
+		"/v/:major-:minor/info",
+		"/a/:x/b",
+	},
+	lookups: []lookupTest{{
+		path:          "/files/report.pdf",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/files/:name.:ext"},
+		expectParams:  hroute.Params{{"name", "report"}, {"ext", "pdf"}},
+	}, {
+		path:          "/files/report.tar.gz",
+		matchIndex:    0,
+		expectHandler: pathHandler{"GET", "/files/:name.:ext"},
+		expectParams:  hroute.Params{{"name", "report.tar"}, {"ext", "gz"}},
+	}, {
+		path:          "/files/report",
+		matchIndex:    1,
+		expectHandler: pathHandler{"GET", "/files/:name"},
+		expectParams:  hroute.Params{{"name", "report"}},
+	}, {
+		path:          "/v/1-2/info",
+		matchIndex:    2,
+		expectHandler: pathHandler{"GET", "/v/:major-:minor/info"},
+		expectParams:  hroute.Params{{"major", "1"}, {"minor", "2"}},
+	}, {
+		path:          "/v/12/info",
+		matchIndex:    -1,
+		expectHandler: hroute.NotFound{},
+	}, {
+		path:          "/a/x.y/b",
+		matchIndex:    3,
+		expectHandler: pathHandler{"GET", "/a/:x/b"},
+		expectParams:  hroute.Params{{"x", "x.y"}},
+	}},
 }, {
 	about: "wildcard method matches any method",
 	add: []string{
@@ -378,10 +881,31 @@ var handlerTests = []struct {
 }}
 
 func TestHandlerToUse(t *testing.T) {
+	testHandlerToUse(t, hroute.New)
+}
+
+func TestHandlerToUseWithNewParams(t *testing.T) {
+	called := 0
+	testHandlerToUse(t, func() *hroute.Router {
+		r := hroute.New()
+		r.NewParams = func(n int) hroute.Params {
+			called++
+			// Deliberately allocate too little space so that
+			// we check that the Params are grown as needed.
+			return make(hroute.Params, 0, 1)
+		}
+		return r
+	})
+	if called == 0 {
+		t.Fatalf("NewParams never called")
+	}
+}
+
+func testHandlerToUse(t *testing.T, newRouter func() *hroute.Router) {
 	for i, test := range handlerTests {
 		t.Logf("test %d: %v", i, test.about)
 
-		r := hroute.New()
+		r := newRouter()
 		pats := make([]*hroute.Pattern, len(test.add))
 		for i, p := range test.add {
 			method, path := methodAndPath(p)
@@ -451,3 +975,2127 @@ type pathHandler struct {
 
 func (h pathHandler) ServeRoute(w http.ResponseWriter, req *http.Request, params hroute.Params) {
 }
+
+func TestWalk(t *testing.T) {
+	r := hroute.New()
+	added := make(map[string]bool)
+	for _, p := range []string{"/a", "/a/:x", "POST /b/*rest", "* /c"} {
+		method, path := methodAndPath(p)
+		r.Handle(method, path, pathHandler{method, path})
+		added[method+" "+path] = true
+	}
+	walked := make(map[string]bool)
+	r.Walk(func(method string, pat *hroute.Pattern, h hroute.Handler) bool {
+		key := method + " " + pat.String()
+		if walked[key] {
+			t.Errorf("route %q walked twice", key)
+		}
+		walked[key] = true
+		if got, want := h, (pathHandler{method, pat.String()}); got != want {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", key, got, want)
+		}
+		return true
+	})
+	if !reflect.DeepEqual(walked, added) {
+		t.Fatalf("unexpected walked routes; got %v want %v", walked, added)
+	}
+
+	n := 0
+	r.Walk(func(string, *hroute.Pattern, hroute.Handler) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("walk did not stop early; called %d times", n)
+	}
+}
+
+func TestNormalizeMethod(t *testing.T) {
+	r := hroute.New()
+	r.NormalizeMethod = true
+	r.Handle("GET", "/a", pathHandler{"GET", "/a"})
+	r.Handle("post", "/a", pathHandler{"POST", "/a"})
+	for _, method := range []string{"get", "GET", "Get"} {
+		h, _, _ := r.HandlerToUse(method, "/a")
+		if got, want := h, hroute.Handler(pathHandler{"GET", "/a"}); got != want {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", method, got, want)
+		}
+	}
+	h, _, _ := r.HandlerToUse("POST", "/a")
+	if got, want := h, hroute.Handler(pathHandler{"POST", "/a"}); got != want {
+		t.Errorf("unexpected handler for POST; got %#v want %#v", got, want)
+	}
+
+	r = hroute.New()
+	r.Handle("GET", "/a", pathHandler{"GET", "/a"})
+	h, _, _ = r.HandlerToUse("get", "/a")
+	if got, want := h, hroute.Handler(hroute.MethodNotAllowed{}); got != want {
+		t.Errorf("unexpected handler without normalization; got %#v want %#v", got, want)
+	}
+}
+
+func TestHandleLocalized(t *testing.T) {
+	r := hroute.New()
+	h := nopHandler("about")
+	r.HandleLocalized("about", map[string]string{
+		"en": "/about/:section",
+		"es": "/acerca/:section",
+	}, "GET", h)
+	for _, path := range []string{"/about/team", "/acerca/team"} {
+		gotH, gotParams, _ := r.Handler("GET", path)
+		if gotH != hroute.Handler(h) {
+			t.Errorf("unexpected handler for %q; got %#v", path, gotH)
+		}
+		if want := (hroute.Params{{"section", "team"}}); !reflect.DeepEqual(gotParams, want) {
+			t.Errorf("unexpected params for %q; got %#v want %#v", path, gotParams, want)
+		}
+	}
+	for _, test := range []struct {
+		locale string
+		expect string
+	}{{"en", "/about/history"}, {"es", "/acerca/history"}} {
+		got, err := r.URLLocalized("about", test.locale, "section", "history")
+		if err != nil {
+			t.Fatalf("unexpected error for locale %q: %v", test.locale, err)
+		}
+		if got != test.expect {
+			t.Errorf("unexpected URL for locale %q; got %q want %q", test.locale, got, test.expect)
+		}
+	}
+	if _, err := r.URLLocalized("about", "fr", "section", "x"); err == nil {
+		t.Errorf("expected error for unknown locale")
+	}
+	if _, err := r.URLLocalized("about", "en"); err == nil {
+		t.Errorf("expected error for missing parameter")
+	}
+
+	if !r.Remove("GET", "/acerca/:section") {
+		t.Fatalf("cannot remove localized route")
+	}
+	if _, err := r.URLLocalized("about", "es", "section", "x"); err == nil {
+		t.Errorf("expected error for removed locale")
+	}
+	if got, err := r.URLLocalized("about", "en", "section", "x"); got != "/about/x" || err != nil {
+		t.Errorf("unexpected URL for remaining locale; got %q, %v", got, err)
+	}
+	r.Remove("GET", "/about/:section")
+	if _, err := r.URLLocalized("about", "en", "section", "x"); err == nil {
+		t.Errorf("expected error after removing all locales")
+	}
+	// The name can be used again once all its routes have gone.
+	r.HandleLocalized("about", map[string]string{"en": "/about/:section"}, "GET", h)
+}
+
+func TestLookupCatchAll(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a/b", pathHandler{"GET", "/a/b"})
+	r.Handle("GET", "/a/*rest", pathHandler{"GET", "/a/*rest"})
+	for _, test := range []struct {
+		path           string
+		expectCatchAll bool
+	}{
+		{"/a/b", false},
+		{"/a/c", true},
+		{"/a/", true},
+	} {
+		res := r.Lookup("GET", test.path)
+		if res.Handler == nil {
+			t.Fatalf("no handler found for %q", test.path)
+		}
+		if res.CatchAll != test.expectCatchAll {
+			t.Errorf("unexpected CatchAll for %q; got %v want %v", test.path, res.CatchAll, test.expectCatchAll)
+		}
+	}
+	if res := r.Lookup("GET", "/b"); !reflect.DeepEqual(res, hroute.LookupResult{}) {
+		t.Errorf("unexpected result for missing route: %#v", res)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	r := hroute.New()
+	r.Handle("PUT", "/a/:x", nopHandler("put"))
+	r.Handle("GET", "/a/:x", nopHandler("get"))
+	r.Handle("DELETE", "/b/", nopHandler("delete"))
+	r.Handle("GET", "/b/*rest", nopHandler("get"))
+	r.HandleAny("/c", nopHandler("any"))
+	r.Handle("POST", "/c", nopHandler("post"))
+	for _, test := range []struct {
+		path          string
+		expectMethods []string
+	}{
+		{"/a/1", []string{"GET", "PUT"}},
+		{"/b/", []string{"DELETE", "GET"}},
+		{"/b/c", []string{"GET"}},
+		{"/c", []string{"*", "POST"}},
+		{"/d", nil},
+		{"/a", nil},
+	} {
+		if got := r.Methods(test.path); !reflect.DeepEqual(got, test.expectMethods) {
+			t.Errorf("unexpected methods for %q; got %q want %q", test.path, got, test.expectMethods)
+		}
+	}
+}
+
+func TestUseEncodedPath(t *testing.T) {
+	var got string
+	r := hroute.New()
+	r.HandleFunc("GET", "/files/:name", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		got = "name=" + p.Get("name")
+	})
+	r.HandleFunc("GET", "/files/:dir/:name", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		got = "dir=" + p.Get("dir") + " name=" + p.Get("name")
+	})
+	r.HandleFunc("GET", "/raw/*rest", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		got = "rest=" + p.Get("rest")
+	})
+	for _, test := range []struct {
+		encoded bool
+		url     string
+		expect  string
+	}{
+		{false, "/files/a%2Fb", "dir=a name=b"},
+		{true, "/files/a%2Fb", "name=a/b"},
+		{true, "/files/a%20b", "name=a b"},
+		{true, "/files/a/b", "dir=a name=b"},
+		{true, "/raw/x%2Fy/z", "rest=/x/y/z"},
+	} {
+		r.UseEncodedPath = test.encoded
+		got = ""
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, mustNewRequest("GET", test.url))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s (encoded %v): unexpected status %d", test.url, test.encoded, rec.Code)
+		}
+		if got != test.expect {
+			t.Errorf("%s (encoded %v): got %q want %q", test.url, test.encoded, got, test.expect)
+		}
+	}
+
+	// net/http rejects such a request before it reaches the
+	// router, but a request can be constructed with a bad RawPath.
+	r.UseEncodedPath = true
+	got = ""
+	req := mustNewRequest("GET", "/files/a%2Fb")
+	req.URL.RawPath = "/files/a%ZZ"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for invalid RawPath; got %d want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got != "" {
+		t.Errorf("handler called for invalid RawPath: %q", got)
+	}
+}
+
+func TestLookupKind(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a/b", pathHandler{"GET", "/a/b"})
+	r.Handle("GET", "/a/:x/c", pathHandler{"GET", "/a/:x/c"})
+	r.Handle("GET", "/a/*rest", pathHandler{"GET", "/a/*rest"})
+	for _, test := range []struct {
+		path       string
+		expectKind hroute.MatchKind
+	}{
+		{"/a/b", hroute.MatchStatic},
+		{"/a/x/c", hroute.MatchWildcard},
+		{"/a/x/d", hroute.MatchCatchAll},
+		{"/b", hroute.MatchNone},
+	} {
+		if got := r.Lookup("GET", test.path).Kind; got != test.expectKind {
+			t.Errorf("unexpected kind for %q; got %v want %v", test.path, got, test.expectKind)
+		}
+	}
+	if got, want := hroute.MatchCatchAll.String(), "catch-all"; got != want {
+		t.Errorf("unexpected string; got %q want %q", got, want)
+	}
+}
+
+func TestParamsAppend(t *testing.T) {
+	ps := hroute.Params{{"a", "1"}}
+	ps = ps.Append("b", "2")
+	if want := (hroute.Params{{"a", "1"}, {"b", "2"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params; got %#v want %#v", ps, want)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on duplicate key")
+		}
+	}()
+	ps.Append("a", "3")
+}
+
+func TestParamsSetDel(t *testing.T) {
+	ps := hroute.Params{{"a", "1"}, {"b", "2"}}
+	ps = ps.Set("b", "3")
+	if want := (hroute.Params{{"a", "1"}, {"b", "3"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params after replacing; got %#v want %#v", ps, want)
+	}
+	ps = ps.Set("c", "4")
+	if want := (hroute.Params{{"a", "1"}, {"b", "3"}, {"c", "4"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params after adding; got %#v want %#v", ps, want)
+	}
+	ps = ps.Del("a")
+	if want := (hroute.Params{{"b", "3"}, {"c", "4"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params after deleting; got %#v want %#v", ps, want)
+	}
+	ps = ps.Del("x")
+	if want := (hroute.Params{{"b", "3"}, {"c", "4"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params after deleting missing key; got %#v want %#v", ps, want)
+	}
+	var empty hroute.Params
+	if ps := empty.Set("a", "1"); !reflect.DeepEqual(ps, hroute.Params{{"a", "1"}}) {
+		t.Fatalf("unexpected params after setting on nil; got %#v", ps)
+	}
+}
+
+func TestParamsTypedGetters(t *testing.T) {
+	ps := hroute.Params{
+		{"id", "42"},
+		{"neg", "-7"},
+		{"big", "9223372036854775808"},
+		{"empty", ""},
+		{"flag", "true"},
+		{"word", "abc"},
+	}
+	if v, err := ps.GetInt("id"); err != nil || v != 42 {
+		t.Errorf("GetInt(id) = %v, %v; want 42, nil", v, err)
+	}
+	if v, err := ps.GetInt64("neg"); err != nil || v != -7 {
+		t.Errorf("GetInt64(neg) = %v, %v; want -7, nil", v, err)
+	}
+	if v, err := ps.GetBool("flag"); err != nil || !v {
+		t.Errorf("GetBool(flag) = %v, %v; want true, nil", v, err)
+	}
+	for _, test := range []struct {
+		f           func() error
+		expectError string
+	}{{
+		f:           func() error { _, err := ps.GetInt("missing"); return err },
+		expectError: `parameter "missing" not found`,
+	}, {
+		f:           func() error { _, err := ps.GetInt64("big"); return err },
+		expectError: `invalid value for parameter "big": strconv.ParseInt: parsing "9223372036854775808": value out of range`,
+	}, {
+		f:           func() error { _, err := ps.GetInt("empty"); return err },
+		expectError: `invalid value for parameter "empty": strconv.ParseInt: parsing "": invalid syntax`,
+	}, {
+		f:           func() error { _, err := ps.GetBool("word"); return err },
+		expectError: `invalid value for parameter "word": strconv.ParseBool: parsing "abc": invalid syntax`,
+	}, {
+		f:           func() error { _, err := ps.GetBool("missing"); return err },
+		expectError: `parameter "missing" not found`,
+	}} {
+		if err := test.f(); err == nil || err.Error() != test.expectError {
+			t.Errorf("unexpected error; got %v want %q", err, test.expectError)
+		}
+	}
+}
+
+func TestParamsWithQuery(t *testing.T) {
+	req := mustNewRequest("GET", "/foo?page=2&tag=a&tag=b&x=y")
+	ps := hroute.Params{{"id", "1"}}.WithQuery(req, "tag", "page", "missing")
+	want := hroute.Params{{"id", "1"}, {"tag", "a"}, {"tag", "b"}, {"page", "2"}}
+	if !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params; got %#v want %#v", ps, want)
+	}
+	if got, want := ps.GetAll("tag"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected tags; got %q want %q", got, want)
+	}
+	ps = hroute.Params{{"id", "1"}}.WithQuery(mustNewRequest("GET", "/foo"), "page")
+	if want := (hroute.Params{{"id", "1"}}); !reflect.DeepEqual(ps, want) {
+		t.Fatalf("unexpected params with no query; got %#v want %#v", ps, want)
+	}
+}
+
+func TestParamsString(t *testing.T) {
+	for _, test := range []struct {
+		params hroute.Params
+		expect string
+	}{
+		{nil, ""},
+		{hroute.Params{}, ""},
+		{hroute.Params{{"id", "42"}}, "id=42"},
+		{hroute.Params{{"foo", "bar"}, {"path", "/a/b"}}, "foo=bar, path=/a/b"},
+	} {
+		if got := test.params.String(); got != test.expect {
+			t.Errorf("unexpected string for %#v; got %q want %q", test.params, got, test.expect)
+		}
+	}
+	if got := fmt.Sprint(hroute.Params{{"a", "b"}}); got != "a=b" {
+		t.Errorf("unexpected formatted params %q", got)
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	r := hroute.New()
+	r.MaxPathLength = 10
+	r.Handle("GET", "/*path", pathHandler{"GET", "/*path"})
+	h, _, _ := r.HandlerToUse("GET", "/0123456789")
+	if got, want := h, hroute.Handler(hroute.RequestURITooLong{}); got != want {
+		t.Fatalf("unexpected handler for long path; got %#v want %#v", got, want)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/0123456789"))
+	if got, want := w.Code, http.StatusRequestURITooLong; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	h, _, _ = r.HandlerToUse("GET", "/012345678")
+	if got, want := h, hroute.Handler(pathHandler{"GET", "/*path"}); got != want {
+		t.Fatalf("unexpected handler for short path; got %#v want %#v", got, want)
+	}
+}
+
+func TestMaxSegments(t *testing.T) {
+	r := hroute.New()
+	r.MaxSegments = 3
+	r.Handle("GET", "/*path", pathHandler{"GET", "/*path"})
+	h, _, _ := r.HandlerToUse("GET", "/a/b/c/d")
+	if got, want := h, hroute.Handler(hroute.RequestURITooLong{}); got != want {
+		t.Fatalf("unexpected handler for path with many segments; got %#v want %#v", got, want)
+	}
+	h, _, _ = r.HandlerToUse("GET", "/a/b/c")
+	if got, want := h, hroute.Handler(pathHandler{"GET", "/*path"}); got != want {
+		t.Fatalf("unexpected handler for path with few segments; got %#v want %#v", got, want)
+	}
+	if _, _, ok := r.RedirectTarget("GET", "/a//b/c/"); ok {
+		t.Errorf("unexpected redirect for path with many segments")
+	}
+}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string {
+	return "not found"
+}
+
+func TestPanicStatus(t *testing.T) {
+	r := hroute.New()
+	r.PanicStatus = map[reflect.Type]int{
+		reflect.TypeOf(notFoundError{}): http.StatusNotFound,
+	}
+	r.HandleFunc("GET", "/missing", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		panic(notFoundError{})
+	})
+	r.HandleFunc("GET", "/other", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		panic("other")
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("GET", "/missing"))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+
+	var panicked interface{}
+	r.Panic = func(w http.ResponseWriter, req *http.Request, h hroute.Handler, p hroute.Params, err interface{}) {
+		panicked = err
+	}
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/other"))
+	if panicked != "other" {
+		t.Fatalf("unmapped panic not passed to Panic; got %#v", panicked)
+	}
+}
+
+var paramsEqualTests = []struct {
+	a, b   hroute.Params
+	expect bool
+}{{
+	a:      nil,
+	b:      hroute.Params{},
+	expect: true,
+}, {
+	a:      hroute.Params{{"a", "1"}, {"b", "2"}},
+	b:      hroute.Params{{"b", "2"}, {"a", "1"}},
+	expect: true,
+}, {
+	a:      hroute.Params{{"a", "1"}, {"b", "2"}},
+	b:      hroute.Params{{"a", "1"}, {"b", "3"}},
+	expect: false,
+}, {
+	a:      hroute.Params{{"a", "1"}, {"b", "2"}},
+	b:      hroute.Params{{"a", "1"}, {"c", "2"}},
+	expect: false,
+}, {
+	a:      hroute.Params{{"a", "1"}},
+	b:      hroute.Params{{"a", "1"}, {"b", "2"}},
+	expect: false,
+}}
+
+func TestParamsEqual(t *testing.T) {
+	for i, test := range paramsEqualTests {
+		if got := test.a.Equal(test.b); got != test.expect {
+			t.Errorf("test %d: %v.Equal(%v); got %v want %v", i, test.a, test.b, got, test.expect)
+		}
+		if got := test.b.Equal(test.a); got != test.expect {
+			t.Errorf("test %d: %v.Equal(%v); got %v want %v", i, test.b, test.a, got, test.expect)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a", pathHandler{"GET", "/a"})
+	r.Freeze()
+	if h, _, _ := r.Handler("GET", "/a"); h != hroute.Handler(pathHandler{"GET", "/a"}) {
+		t.Fatalf("unexpected handler after freeze: %#v", h)
+	}
+	defer func() {
+		err := recover()
+		if err == nil {
+			t.Fatalf("expected panic registering on frozen router")
+		}
+		if got, want := fmt.Sprint(err), `cannot register GET "/b" on frozen router`; got != want {
+			t.Fatalf("unexpected panic; got %q want %q", got, want)
+		}
+	}()
+	r.Handle("GET", "/b", pathHandler{"GET", "/b"})
+}
+
+func TestHandleAny(t *testing.T) {
+	r := hroute.New()
+	r.HandleAny("/a", nopHandler("any"))
+	r.Handle("PUT", "/a", nopHandler("put"))
+	for _, test := range []struct {
+		method string
+		expect hroute.Handler
+	}{
+		{"GET", nopHandler("any")},
+		{"OPTIONS", nopHandler("any")},
+		{"PUT", nopHandler("put")},
+	} {
+		if h, _, _ := r.Handler(test.method, "/a"); h != test.expect {
+			t.Errorf("unexpected handler for %s; got %#v want %#v", test.method, h, test.expect)
+		}
+	}
+}
+
+func TestParamsGetAll(t *testing.T) {
+	ps := hroute.Params{{"id", "1"}, {"tag", "a"}, {"tag", "b"}}
+	if got, want := ps.GetAll("tag"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected values; got %q want %q", got, want)
+	}
+	if got, want := ps.Get("tag"), "a"; got != want {
+		t.Fatalf("unexpected value; got %q want %q", got, want)
+	}
+	if got, want := ps.GetAll("id"), []string{"1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected values; got %q want %q", got, want)
+	}
+	if got := ps.GetAll("other"); got != nil {
+		t.Fatalf("unexpected values for missing key: %q", got)
+	}
+}
+
+func TestParsePatternClean(t *testing.T) {
+	pat, err := hroute.ParsePatternClean("/a//b/./:c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := pat.String(), "/a/b/:c"; got != want {
+		t.Fatalf("unexpected pattern; got %q want %q", got, want)
+	}
+	if _, err := hroute.ParsePattern("/a//b/:c"); err == nil {
+		t.Fatalf("expected error from ParsePattern with unclean pattern")
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	r := hroute.New()
+	var statuses []int
+	r.ErrorHandler = func(w http.ResponseWriter, req *http.Request, status int, p hroute.Params) {
+		statuses = append(statuses, status)
+		w.WriteHeader(status)
+	}
+	r.HandleFunc("GET", "/panic", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		panic("oops")
+	})
+	for _, test := range []struct {
+		method string
+		path   string
+		expect int
+	}{
+		{"GET", "/missing", http.StatusNotFound},
+		{"POST", "/panic", http.StatusMethodNotAllowed},
+		{"GET", "/panic", http.StatusInternalServerError},
+	} {
+		statuses = nil
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, mustNewRequest(test.method, test.path))
+		if want := []int{test.expect}; !reflect.DeepEqual(statuses, want) {
+			t.Errorf("%s %s: unexpected error handler calls; got %v want %v", test.method, test.path, statuses, want)
+		}
+		if w.Code != test.expect {
+			t.Errorf("%s %s: unexpected status; got %d want %d", test.method, test.path, w.Code, test.expect)
+		}
+	}
+}
+
+func TestRouterString(t *testing.T) {
+	r := hroute.New()
+	for _, p := range []string{"/a", "POST /a", "/b/:x", "PUT /c"} {
+		method, path := methodAndPath(p)
+		r.Handle(method, path, pathHandler{method, path})
+	}
+	s := r.String()
+	if !strings.Contains(s, "4 routes") {
+		t.Fatalf("route count not found in %q", s)
+	}
+	if !strings.Contains(s, "methods GET,POST,PUT") {
+		t.Fatalf("methods not found in %q", s)
+	}
+	if got, want := hroute.New().String(), "hroute.Router{0 routes}"; got != want {
+		t.Fatalf("unexpected string for empty router; got %q want %q", got, want)
+	}
+}
+
+func TestNotFoundByMethod(t *testing.T) {
+	r := hroute.New()
+	r.Handle("POST", "/api/items", nopHandler("items"))
+	r.NotFoundByMethod = map[string]hroute.Handler{
+		"GET": nopHandler("spa"),
+	}
+	for _, test := range []struct {
+		method string
+		path   string
+		expect hroute.Handler
+	}{
+		{"GET", "/dashboard", nopHandler("spa")},
+		{"POST", "/dashboard", hroute.NotFound{}},
+		{"GET", "/api/items", hroute.MethodNotAllowed{}},
+	} {
+		if h, _, _ := r.HandlerToUse(test.method, test.path); h != test.expect {
+			t.Errorf("unexpected handler for %s %s; got %#v want %#v", test.method, test.path, h, test.expect)
+		}
+	}
+}
+
+func TestPatternSegments(t *testing.T) {
+	pat, err := hroute.ParsePattern("/users/:id/posts/**mid/x/*rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []hroute.Segment{
+		{Text: "users"},
+		{Wildcard: true, Text: "id"},
+		{Text: "posts"},
+		{Wildcard: true, Text: "mid", Multi: true},
+		{Text: "x"},
+		{Wildcard: true, Text: "rest", CatchAll: true},
+	}
+	if got := pat.Segments(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected segments; got %#v want %#v", got, want)
+	}
+	pat, err = hroute.ParsePattern("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pat.Segments(); len(got) != 0 {
+		t.Fatalf("unexpected segments for /: %#v", got)
+	}
+}
+
+func TestCleanPathRedirectCode(t *testing.T) {
+	r := hroute.New()
+	r.CleanPathRedirectCode = http.StatusPermanentRedirect
+	r.Handle("POST", "/a/b", nopHandler("ab"))
+	r.Handle("POST", "/c/", nopHandler("c"))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, mustNewRequest("POST", "/a//b"))
+	if got, want := w.Code, http.StatusPermanentRedirect; got != want {
+		t.Fatalf("unexpected status; got %d want %d", got, want)
+	}
+	if got, want := w.Header().Get("Location"), "/a/b"; got != want {
+		t.Fatalf("unexpected location; got %q want %q", got, want)
+	}
+
+	// Slash redirects are unaffected.
+	h, _, _ := r.HandlerToUse("POST", "/c")
+	if want := (hroute.Redirect{Path: "/c/", Code: http.StatusTemporaryRedirect}); h != hroute.Handler(want) {
+		t.Fatalf("unexpected slash redirect; got %#v want %#v", h, want)
+	}
+}
+
+func TestHandleFuncAny(t *testing.T) {
+	r := hroute.New()
+	var called string
+	r.HandleFuncAny("/a", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		called = "any"
+	})
+	r.HandleFunc("GET", "/a", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		called = "get"
+	})
+	for _, test := range []struct {
+		method string
+		expect string
+	}{
+		{"PATCH", "any"},
+		{"GET", "get"},
+	} {
+		called = ""
+		r.ServeHTTP(httptest.NewRecorder(), mustNewRequest(test.method, "/a"))
+		if called != test.expect {
+			t.Errorf("unexpected handler for %s; got %q want %q", test.method, called, test.expect)
+		}
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/foo/", nopHandler("foo"))
+	r.Handle("GET", "/bar", nopHandler("bar"))
+	r.HandleAny("/any/", nopHandler("any"))
+
+	target, code, ok := r.RedirectTarget("GET", "/foo")
+	if !ok || target != "/foo/" || code != http.StatusMovedPermanently {
+		t.Errorf("unexpected redirect for /foo; got %q %d %v", target, code, ok)
+	}
+	target, code, ok = r.RedirectTarget("POST", "/any")
+	if !ok || target != "/any/" || code != http.StatusTemporaryRedirect {
+		t.Errorf("unexpected redirect for POST /any; got %q %d %v", target, code, ok)
+	}
+	target, code, ok = r.RedirectTarget("GET", "/x/../bar")
+	if !ok || target != "/bar" || code != http.StatusMovedPermanently {
+		t.Errorf("unexpected redirect for /x/../bar; got %q %d %v", target, code, ok)
+	}
+	if target, code, ok := r.RedirectTarget("GET", "/bar"); ok {
+		t.Errorf("unexpected redirect for /bar; got %q %d", target, code)
+	}
+	if target, code, ok := r.RedirectTarget("GET", "/nothing"); ok {
+		t.Errorf("unexpected redirect for /nothing; got %q %d", target, code)
+	}
+}
+
+func TestDisableRedirects(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/foo/", nopHandler("foo"))
+	r.DisableRedirects = true
+	for _, path := range []string{"/foo", "/x/../foo/"} {
+		h, _, _ := r.HandlerToUse("GET", path)
+		if _, ok := h.(hroute.NotFound); !ok {
+			t.Errorf("unexpected handler for %q; got %#v want NotFound", path, h)
+		}
+		if target, code, ok := r.RedirectTarget("GET", path); ok {
+			t.Errorf("unexpected redirect for %q; got %q %d", path, target, code)
+		}
+	}
+}
+
+func TestMakeParams(t *testing.T) {
+	pat, err := hroute.ParsePattern("/users/:id/*rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pat.MakeParams("42", "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := hroute.Params{{
+		Key:   "id",
+		Value: "42",
+	}, {
+		Key:   "rest",
+		Value: "/a/b",
+	}}
+	if !ps.Equal(expect) {
+		t.Errorf("unexpected params; got %#v want %#v", ps, expect)
+	}
+	if _, err := pat.MakeParams("42"); err == nil {
+		t.Errorf("expected error with too few parameters")
+	}
+	if _, err := pat.MakeParams("42", "a/b"); err == nil {
+		t.Errorf("expected error with catch-all parameter without leading slash")
+	}
+}
+
+func TestOverlappingConstraintsOrder(t *testing.T) {
+	patterns := []string{
+		`/o/:id([0-9a-f]+)`,
+		`/o/:id(\d+)`,
+		`/o/:id(42)`,
+	}
+	for _, reverse := range []bool{false, true} {
+		r := hroute.New()
+		for i := range patterns {
+			p := patterns[i]
+			if reverse {
+				p = patterns[len(patterns)-1-i]
+			}
+			r.Handle("GET", p, pathHandler{"GET", p})
+		}
+		for _, test := range []struct {
+			path   string
+			expect string
+		}{
+			// The literal constraint is preferred.
+			{"/o/42", `/o/:id(42)`},
+			// Otherwise the constraints are tried in
+			// lexical order.
+			{"/o/12", `/o/:id([0-9a-f]+)`},
+			{"/o/ab", `/o/:id([0-9a-f]+)`},
+		} {
+			h, _, _ := r.HandlerToUse("GET", test.path)
+			if want := (pathHandler{"GET", test.expect}); h != want {
+				t.Errorf("%s (reverse %v): unexpected handler; got %#v want %#v", test.path, reverse, h, want)
+			}
+		}
+	}
+}
+
+func TestConstraintNamedGroups(t *testing.T) {
+	r := hroute.New()
+	var maxParams int
+	r.NewParams = func(n int) hroute.Params {
+		maxParams = n
+		return make(hroute.Params, 0, n)
+	}
+	r.Handle("GET", `/:ver(v(?P<major>\d+)(?:\.(?P<minor>\d+))?)`, nopHandler("ver"))
+	r.Handle("GET", `/:ver(v(?P<major>\d+)(?:\.(?P<minor>\d+))?)/*rest`, nopHandler("rest"))
+	for _, test := range []struct {
+		path         string
+		expectParams hroute.Params
+	}{{
+		path:         "/v2",
+		expectParams: hroute.Params{{"ver", "v2"}, {"major", "2"}, {"minor", ""}},
+	}, {
+		path:         "/v2.1",
+		expectParams: hroute.Params{{"ver", "v2.1"}, {"major", "2"}, {"minor", "1"}},
+	}, {
+		// The catch-all parameter is still last.
+		path:         "/v3/a/b",
+		expectParams: hroute.Params{{"ver", "v3"}, {"major", "3"}, {"minor", ""}, {"rest", "/a/b"}},
+	}} {
+		_, ps, pat := r.HandlerToUse("GET", test.path)
+		if pat == nil {
+			t.Fatalf("no route found for %q", test.path)
+		}
+		if !reflect.DeepEqual(ps, test.expectParams) {
+			t.Errorf("unexpected params for %q; got %#v want %#v", test.path, ps, test.expectParams)
+		}
+		var keys []string
+		for _, p := range test.expectParams {
+			keys = append(keys, p.Key)
+		}
+		if got := pat.Keys(); !reflect.DeepEqual(got, keys) {
+			t.Errorf("unexpected keys for %q; got %q want %q", test.path, got, keys)
+		}
+		if maxParams < len(test.expectParams) {
+			t.Errorf("too few params allocated for %q; got %d want at least %d", test.path, maxParams, len(test.expectParams))
+		}
+		if got, err := pat.PathWithParams(ps); got != test.path || err != nil {
+			t.Errorf("unexpected path from params for %q; got %q, %v", test.path, got, err)
+		}
+	}
+
+	pat, err := hroute.ParsePattern(`/:ver(v(?P<major>\d+))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pat.Path("v2"); got != "/v2" || err != nil {
+		t.Errorf("unexpected path; got %q, %v", got, err)
+	}
+	ps, err := pat.MakeParams("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (hroute.Params{{"ver", "v2"}, {"major", "2"}}); !reflect.DeepEqual(ps, want) {
+		t.Errorf("unexpected params from MakeParams; got %#v want %#v", ps, want)
+	}
+	ps, ok := pat.Matches("/v7")
+	if want := (hroute.Params{{"ver", "v7"}, {"major", "7"}}); !ok || !reflect.DeepEqual(ps, want) {
+		t.Errorf("unexpected params from Matches; got %#v, %v want %#v", ps, ok, want)
+	}
+}
+
+func TestPathWithParams(t *testing.T) {
+	r := hroute.New()
+	for _, pattern := range []string{
+		"/users/:id",
+		"/users/:id/files/*path",
+		"/static/*path",
+		"/a/:x/b/:y",
+	} {
+		r.Handle("GET", pattern, nopHandler(pattern))
+	}
+	for _, path := range []string{
+		"/users/42",
+		"/users/42/files/a/b.txt",
+		"/static/",
+		"/a/1/b/2",
+	} {
+		_, ps, pat := r.HandlerToUse("GET", path)
+		if pat == nil {
+			t.Fatalf("no pattern found for %q", path)
+		}
+		got, err := pat.PathWithParams(ps)
+		if err != nil {
+			t.Errorf("PathWithParams for %q: %v", path, err)
+			continue
+		}
+		if got != path {
+			t.Errorf("unexpected path; got %q want %q", got, path)
+		}
+	}
+	pat, err := hroute.ParsePattern("/users/:id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pat.PathWithParams(hroute.Params{{Key: "other", Value: "x"}}); err == nil {
+		t.Errorf("expected error with missing parameter")
+	}
+	if _, err := pat.PathWithParams(hroute.Params{{Key: "id", Value: ""}}); err == nil {
+		t.Errorf("expected error with empty parameter")
+	}
+	_, err = pat.PathWithParams(hroute.Params{{Key: "id", Value: "a/b"}})
+	if got, want := fmt.Sprint(err), `parameter "id" contains /`; got != want {
+		t.Errorf("unexpected error with slash in parameter; got %q want %q", got, want)
+	}
+
+	// Catch-all and multi-segment values may contain slashes.
+	pat, err = hroute.ParsePattern("/a/**mid/z/*rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pat.Path("b/c", "/d/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/a/b/c/z/d/e"; got != want {
+		t.Errorf("unexpected path; got %q want %q", got, want)
+	}
+}
+
+var redirectFixedPathTests = []struct {
+	path   string
+	expect string
+}{{
+	path:   "/Foo/Bar",
+	expect: "/foo/bar",
+}, {
+	path:   "/FOO/BAR/",
+	expect: "/foo/bar",
+}, {
+	path:   "/Users/MixedCase/Profile",
+	expect: "/users/MixedCase/profile",
+}, {
+	path:   "/STATIC/Some/File.TXT",
+	expect: "/static/Some/File.TXT",
+}, {
+	path:   "/A/x/Y/Z/tail",
+	expect: "/a/x/Y/Z/tail",
+}, {
+	path:   "/fob",
+	expect: "",
+}}
+
+func TestRedirectFixedPath(t *testing.T) {
+	r := hroute.New()
+	r.RedirectFixedPath = true
+	for _, pattern := range []string{
+		"/foo/bar",
+		"/foo/baz",
+		"/users/:id/profile",
+		"/static/*path",
+		"/a/**rest/tail",
+	} {
+		r.Handle("GET", pattern, nopHandler(pattern))
+	}
+	for _, test := range redirectFixedPathTests {
+		h, _, _ := r.HandlerToUse("GET", test.path)
+		if test.expect == "" {
+			if _, ok := h.(hroute.NotFound); !ok {
+				t.Errorf("unexpected handler for %q; got %#v want NotFound", test.path, h)
+			}
+			continue
+		}
+		expect := hroute.Redirect{
+			Path: test.expect,
+			Code: http.StatusMovedPermanently,
+		}
+		if h != expect {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", test.path, h, expect)
+		}
+	}
+	r.RedirectFixedPath = false
+	h, _, _ := r.HandlerToUse("GET", "/Foo/Bar")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler with RedirectFixedPath unset; got %#v", h)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	r := hroute.New()
+	for _, p := range []string{"POST /b/*rest", "/a/:x", "* /c", "/a", "POST /a", "* /a"} {
+		method, path := methodAndPath(p)
+		r.Handle(method, path, pathHandler{method, path})
+	}
+	var got []string
+	for _, route := range r.Routes() {
+		if want := (pathHandler{route.Method, route.Pattern.String()}); route.Handler != want {
+			t.Errorf("unexpected handler for %s %s; got %#v want %#v", route.Method, route.Pattern, route.Handler, want)
+		}
+		got = append(got, route.Method+" "+route.Pattern.String())
+	}
+	expect := []string{
+		"* /a",
+		"GET /a",
+		"POST /a",
+		"GET /a/:x",
+		"POST /b/*rest",
+		"* /c",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("unexpected routes; got %q want %q", got, expect)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	r := hroute.New()
+	var maxParams int
+	r.NewParams = func(n int) hroute.Params {
+		maxParams = n
+		return make(hroute.Params, 0, n)
+	}
+	r.Handle("GET", "/a", pathHandler{"GET", "/a"})
+	r.Handle("*", "/a", pathHandler{"*", "/a"})
+	r.Handle("GET", "/a/:x", pathHandler{"GET", "/a/:x"})
+	r.Handle("GET", "/b/:x/:y/*z", pathHandler{"GET", "/b/:x/:y/*z"})
+	r.Handle("GET", "/b/:x", pathHandler{"GET", "/b/:x"})
+
+	if r.Remove("POST", "/a") {
+		t.Errorf("unexpected removal of unregistered method")
+	}
+	if r.Remove("GET", "/nothing") {
+		t.Errorf("unexpected removal of unregistered path")
+	}
+	if !r.Remove("*", "/a") {
+		t.Fatalf("cannot remove * /a")
+	}
+	h, _, _ := r.HandlerToUse("GET", "/a")
+	if want := (pathHandler{"GET", "/a"}); h != want {
+		t.Errorf("unexpected handler after removing * /a; got %#v want %#v", h, want)
+	}
+	h, _, _ = r.HandlerToUse("POST", "/a")
+	if _, ok := h.(hroute.MethodNotAllowed); !ok {
+		t.Errorf("unexpected handler for POST after removing * /a; got %#v", h)
+	}
+
+	r.HandlerToUse("GET", "/b/1/2/3")
+	if maxParams != 3 {
+		t.Errorf("unexpected max params; got %d want 3", maxParams)
+	}
+	if !r.Remove("GET", "/b/:x/:y/*z") {
+		t.Fatalf("cannot remove GET /b/:x/:y/*z")
+	}
+	if r.Remove("GET", "/b/:x/:y/*z") {
+		t.Errorf("route removed twice")
+	}
+	h, _, _ = r.HandlerToUse("GET", "/b/1/2/3")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler after removal; got %#v", h)
+	}
+	// The remaining route shares the branch of the removed
+	// one, so the branch must no longer allocate space for
+	// the removed route's parameters.
+	h, _, _ = r.HandlerToUse("GET", "/b/1")
+	if want := (pathHandler{"GET", "/b/:x"}); h != want {
+		t.Errorf("unexpected handler after removal; got %#v want %#v", h, want)
+	}
+	if maxParams != 1 {
+		t.Errorf("unexpected max params after removal; got %d want 1", maxParams)
+	}
+
+	r.Handle("GET", `/a/:n(\d+)`, pathHandler{"GET", `/a/:n(\d+)`})
+	h, _, _ = r.HandlerToUse("GET", "/a/1")
+	if want := (pathHandler{"GET", `/a/:n(\d+)`}); h != want {
+		t.Errorf("unexpected handler for constrained route; got %#v want %#v", h, want)
+	}
+	if !r.Remove("GET", `/a/:n(\d+)`) {
+		t.Fatalf("cannot remove constrained route")
+	}
+	h, _, _ = r.HandlerToUse("GET", "/a/1")
+	if want := (pathHandler{"GET", "/a/:x"}); h != want {
+		t.Errorf("unexpected handler after removing constrained route; got %#v want %#v", h, want)
+	}
+
+	r.Remove("GET", "/a")
+	r.Remove("GET", "/a/:x")
+	r.Remove("GET", "/b/:x")
+	if got, want := r.String(), "hroute.Router{0 routes}"; got != want {
+		t.Errorf("unexpected router after removing all routes; got %q want %q", got, want)
+	}
+	// The tree should still be usable after pruning.
+	r.Handle("GET", "/a/:y", pathHandler{"GET", "/a/:y"})
+	h, _, _ = r.HandlerToUse("GET", "/a/1")
+	if want := (pathHandler{"GET", "/a/:y"}); h != want {
+		t.Errorf("unexpected handler after re-adding; got %#v want %#v", h, want)
+	}
+}
+
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	r := hroute.New()
+	r.Handle("PUT", "/a", nopHandler("put"))
+	r.Handle("GET", "/a", nopHandler("get"))
+	r.Handle("GET", "/b", nopHandler("get"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("POST", "/a"))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status; got %d want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, PUT"; got != want {
+		t.Errorf("unexpected Allow header; got %q want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("POST", "/nothing"))
+	if got := rec.Header().Get("Allow"); got != "" {
+		t.Errorf("unexpected Allow header on not found response: %q", got)
+	}
+
+	r.ErrorHandler = func(w http.ResponseWriter, req *http.Request, status int, p hroute.Params) {
+		w.WriteHeader(status)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("DELETE", "/b"))
+	if got, want := rec.Header().Get("Allow"), "GET"; got != want {
+		t.Errorf("unexpected Allow header with ErrorHandler; got %q want %q", got, want)
+	}
+}
+
+type allowedMethodsHandler struct {
+	allowed *[]string
+}
+
+func (h allowedMethodsHandler) ServeRoute(http.ResponseWriter, *http.Request, hroute.Params) {
+	panic("ServeRoute called")
+}
+
+func (h allowedMethodsHandler) ServeMethodNotAllowed(w http.ResponseWriter, req *http.Request, allowed []string) {
+	*h.allowed = allowed
+	w.WriteHeader(http.StatusTeapot)
+}
+
+func TestMethodNotAllowedHandler(t *testing.T) {
+	var allowed []string
+	r := hroute.New()
+	r.MethodNotAllowed = allowedMethodsHandler{&allowed}
+	r.Handle("PUT", "/a", nopHandler("put"))
+	r.Handle("GET", "/a", nopHandler("get"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("DELETE", "/a"))
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("unexpected status; got %d want %d", rec.Code, http.StatusTeapot)
+	}
+	if want := []string{"GET", "PUT"}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("unexpected allowed methods; got %q want %q", allowed, want)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, PUT"; got != want {
+		t.Errorf("unexpected Allow header; got %q want %q", got, want)
+	}
+
+	r.HandleOPTIONS = true
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("DELETE", "/a"))
+	if want := []string{"GET", "OPTIONS", "PUT"}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("unexpected allowed methods with HandleOPTIONS; got %q want %q", allowed, want)
+	}
+}
+
+func TestHandleOPTIONS(t *testing.T) {
+	r := hroute.New()
+	r.HandleOPTIONS = true
+	r.Handle("PUT", "/a", nopHandler("put"))
+	r.Handle("GET", "/a", nopHandler("get"))
+	r.Handle("OPTIONS", "/b", pathHandler{"OPTIONS", "/b"})
+	r.Handle("GET", "/b", nopHandler("get"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("OPTIONS", "/a"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status; got %d want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, OPTIONS, PUT"; got != want {
+		t.Errorf("unexpected Allow header; got %q want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("DELETE", "/a"))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status; got %d want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, OPTIONS, PUT"; got != want {
+		t.Errorf("unexpected Allow header on 405 response; got %q want %q", got, want)
+	}
+
+	// An explicitly registered OPTIONS handler takes precedence.
+	h, _, _ := r.HandlerToUse("OPTIONS", "/b")
+	if want := (pathHandler{"OPTIONS", "/b"}); h != want {
+		t.Errorf("unexpected handler for OPTIONS /b; got %#v want %#v", h, want)
+	}
+
+	// Paths without any routes are not found.
+	h, _, _ = r.HandlerToUse("OPTIONS", "/nothing")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler for OPTIONS /nothing; got %#v", h)
+	}
+}
+
+func TestAutoHead(t *testing.T) {
+	r := hroute.New()
+	r.AutoHead = true
+	r.HandleFunc("GET", "/a/:x", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		w.Header().Set("X-Param", p.Get("x"))
+		w.Write([]byte("body"))
+	})
+	r.Handle("GET", "/b", nopHandler("get"))
+	r.Handle("HEAD", "/b", pathHandler{"HEAD", "/b"})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("HEAD", "/a/foo"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status; got %d want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("X-Param"), "foo"; got != want {
+		t.Errorf("unexpected header; got %q want %q", got, want)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("unexpected body for HEAD request: %q", rec.Body.String())
+	}
+
+	// An explicitly registered HEAD handler takes precedence.
+	h, _, _ := r.HandlerToUse("HEAD", "/b")
+	if want := (pathHandler{"HEAD", "/b"}); h != want {
+		t.Errorf("unexpected handler for HEAD /b; got %#v want %#v", h, want)
+	}
+
+	r.AutoHead = false
+	h, _, _ = r.HandlerToUse("HEAD", "/a/foo")
+	if _, ok := h.(hroute.MethodNotAllowed); !ok {
+		t.Errorf("unexpected handler with AutoHead unset; got %#v", h)
+	}
+}
+
+func TestUse(t *testing.T) {
+	r := hroute.New()
+	var calls []string
+	mw := func(name string) func(hroute.Handler) hroute.Handler {
+		return func(h hroute.Handler) hroute.Handler {
+			return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+				calls = append(calls, name+" before "+p.Get("id"))
+				h.ServeRoute(w, req, p)
+				calls = append(calls, name+" after")
+			})
+		}
+	}
+	r.Use(mw("a"))
+	r.Use(mw("b"))
+	r.HandleFunc("GET", "/users/:id", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		calls = append(calls, "handler")
+	})
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/users/42"))
+	expect := []string{
+		"a before 42",
+		"b before 42",
+		"handler",
+		"b after",
+		"a after",
+	}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Errorf("unexpected calls; got %q want %q", calls, expect)
+	}
+
+	// Middleware also applies to fallback handlers.
+	calls = nil
+	r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", "/nothing"))
+	if len(calls) != 4 {
+		t.Errorf("unexpected calls for not found path; got %q", calls)
+	}
+}
+
+func TestRedirectTrailingSlashAndCleanPath(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/foo/", nopHandler("foo"))
+	r.Handle("GET", "/bar", nopHandler("bar"))
+
+	r.RedirectTrailingSlash = false
+	h, _, _ := r.HandlerToUse("GET", "/foo")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler with RedirectTrailingSlash unset; got %#v want NotFound", h)
+	}
+	h, _, _ = r.HandlerToUse("GET", "/x/../bar")
+	if want := (hroute.Redirect{Path: "/bar", Code: http.StatusMovedPermanently}); h != want {
+		t.Errorf("unexpected handler for unclean path; got %#v want %#v", h, want)
+	}
+
+	r.RedirectTrailingSlash = true
+	r.RedirectCleanPath = false
+	h, _, _ = r.HandlerToUse("GET", "/x/../bar")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler with RedirectCleanPath unset; got %#v want NotFound", h)
+	}
+	h, _, _ = r.HandlerToUse("GET", "/foo")
+	if want := (hroute.Redirect{Path: "/foo/", Code: http.StatusMovedPermanently}); h != want {
+		t.Errorf("unexpected handler for slash redirect; got %#v want %#v", h, want)
+	}
+}
+
+// BenchmarkShallowWildcardRoute measures a lookup of a route with
+// a single wildcard in a router that also has a route with
+// many wildcards in a different branch of the tree. The
+// parameters allocated should be sized for the shallow route.
+func BenchmarkShallowWildcardRoute(b *testing.B) {
+	r := hroute.New()
+	nop := hroute.HandlerFunc(func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	r.Handle("GET", "/static/path", nop)
+	r.Handle("GET", "/user/:id", nop)
+	r.Handle("GET", "/deep/:a/:b/:c/:d/:e/:f/:g/:h", nop)
+	req := mustNewRequest("GET", "/user/42")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(nil, req)
+	}
+}
+
+// siblingRoutes holds 50 static routes that all diverge
+// at the same node of the routing tree.
+var siblingRoutes = func() []string {
+	const firstBytes = "zyxwvutsrqponmlkjihgfedcbaZYXWVUTSRQPONMLKJIHGFEDCBA"
+	paths := make([]string, 50)
+	for i := range paths {
+		paths[i] = "/api/" + firstBytes[i:i+1] + "item"
+	}
+	return paths
+}()
+
+func TestManySiblingRoutes(t *testing.T) {
+	r := hroute.New()
+	for _, path := range siblingRoutes {
+		r.Handle("GET", path, pathHandler{"GET", path})
+	}
+	for _, path := range siblingRoutes {
+		h, _, _ := r.HandlerToUse("GET", path)
+		if got, want := h, hroute.Handler(pathHandler{"GET", path}); got != want {
+			t.Errorf("unexpected handler for %q; got %#v want %#v", path, got, want)
+		}
+	}
+	if h, _, _ := r.HandlerToUse("GET", "/api/0item"); h != hroute.Handler(hroute.NotFound{}) {
+		t.Errorf("unexpected handler for missing sibling; got %#v", h)
+	}
+	for _, path := range siblingRoutes[:25] {
+		r.Remove("GET", path)
+	}
+	for i, path := range siblingRoutes {
+		h, _, _ := r.HandlerToUse("GET", path)
+		if found := h != hroute.Handler(hroute.NotFound{}); found != (i >= 25) {
+			t.Errorf("unexpected handler for %q after removal; got %#v", path, h)
+		}
+	}
+}
+
+func BenchmarkManySiblingRoutes(b *testing.B) {
+	r := hroute.New()
+	nop := hroute.HandlerFunc(func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	for _, path := range siblingRoutes {
+		r.Handle("GET", path, nop)
+	}
+	req := mustNewRequest("GET", siblingRoutes[len(siblingRoutes)-1])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(nil, req)
+	}
+}
+
+func TestPoolParams(t *testing.T) {
+	r := hroute.New()
+	r.PoolParams = true
+	var got []hroute.Params
+	r.HandleFunc("GET", "/a/:x/:y", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		got = append(got, append(hroute.Params(nil), p...))
+	})
+	r.HandleFunc("GET", "/b/*rest", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		got = append(got, append(hroute.Params(nil), p...))
+	})
+	r.ServeHTTP(nil, mustNewRequest("GET", "/a/1/2"))
+	r.ServeHTTP(nil, mustNewRequest("GET", "/b/c/d"))
+	r.ServeHTTP(nil, mustNewRequest("GET", "/a/3/4"))
+	expect := []hroute.Params{
+		{{"x", "1"}, {"y", "2"}},
+		{{"rest", "/c/d"}},
+		{{"x", "3"}, {"y", "4"}},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("unexpected params; got %v want %v", got, expect)
+	}
+
+	// Once the pool has been populated, serving a request
+	// with parameters should not need to allocate.
+	r = hroute.New()
+	r.PoolParams = true
+	r.HandleFunc("GET", "/a/:x/:y", func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	req := mustNewRequest("GET", "/a/1/2")
+	if n := testing.AllocsPerRun(100, func() {
+		r.ServeHTTP(nil, req)
+	}); n != 0 {
+		t.Errorf("unexpected allocations with PoolParams; got %v want 0", n)
+	}
+}
+
+func TestRedirectCode(t *testing.T) {
+	r := hroute.New()
+	r.Handle("*", "/a/", nopHandler("a"))
+	for _, test := range []struct {
+		method       string
+		code         int
+		nonGETCode   int
+		expectedCode int
+	}{
+		{"GET", 0, 0, http.StatusMovedPermanently},
+		{"POST", 0, 0, http.StatusTemporaryRedirect},
+		{"GET", http.StatusPermanentRedirect, 0, http.StatusPermanentRedirect},
+		{"POST", http.StatusPermanentRedirect, 0, http.StatusTemporaryRedirect},
+		{"POST", 0, http.StatusPermanentRedirect, http.StatusPermanentRedirect},
+		{"GET", 0, http.StatusPermanentRedirect, http.StatusMovedPermanently},
+	} {
+		r.RedirectCode = test.code
+		r.NonGETRedirectCode = test.nonGETCode
+		h, _, _ := r.HandlerToUse(test.method, "/a")
+		if want := (hroute.Redirect{Path: "/a/", Code: test.expectedCode}); h != hroute.Handler(want) {
+			t.Errorf("unexpected redirect for %s with codes %d, %d; got %#v want %#v", test.method, test.code, test.nonGETCode, h, want)
+		}
+	}
+}
+
+func TestAssumeCleanPath(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/foo/bar", nopHandler("bar"))
+	r.Handle("GET", "/dir/", nopHandler("dir"))
+	r.AssumeCleanPath = true
+	h, _, _ := r.HandlerToUse("GET", "/foo//bar")
+	if _, ok := h.(hroute.NotFound); !ok {
+		t.Errorf("unexpected handler for unclean path; got %#v", h)
+	}
+	// Trailing slash redirects still happen.
+	h, _, _ = r.HandlerToUse("GET", "/dir")
+	if want := (hroute.Redirect{Path: "/dir/", Code: http.StatusMovedPermanently}); h != hroute.Handler(want) {
+		t.Errorf("unexpected handler for /dir; got %#v want %#v", h, want)
+	}
+	r.RedirectTrailingSlash = false
+	if n := testing.AllocsPerRun(100, func() {
+		r.HandlerToUse("GET", "/foo//bar")
+	}); n != 0 {
+		t.Errorf("unexpected allocations for unclean path; got %v", n)
+	}
+}
+
+func TestRedirectPreservesQuery(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/foo/bar", nopHandler("bar"))
+	r.Handle("GET", "/dir/", nopHandler("dir"))
+	for _, test := range []struct {
+		url            string
+		expectLocation string
+	}{
+		{"/foo//bar?x=1", "/foo/bar?x=1"},
+		{"/dir?x=1&y=2", "/dir/?x=1&y=2"},
+		{"/dir", "/dir/"},
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, mustNewRequest("GET", test.url))
+		if rec.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: unexpected status; got %d want %d", test.url, rec.Code, http.StatusMovedPermanently)
+		}
+		if got := rec.Header().Get("Location"); got != test.expectLocation {
+			t.Errorf("%s: unexpected location; got %q want %q", test.url, got, test.expectLocation)
+		}
+	}
+}
+
+func TestHandles(t *testing.T) {
+	r := hroute.New()
+	pat := r.Handles([]string{"GET", "HEAD", "POST"}, "/a/:x", pathHandler{"*", "/a/:x"}, hroute.WithName("a"))
+	if got, want := pat.String(), "/a/:x"; got != want {
+		t.Errorf("unexpected pattern; got %q want %q", got, want)
+	}
+	for _, method := range []string{"GET", "HEAD", "POST"} {
+		h, _, gotPat := r.HandlerToUse(method, "/a/1")
+		if want := (pathHandler{"*", "/a/:x"}); h != want {
+			t.Errorf("unexpected handler for %s; got %#v want %#v", method, h, want)
+		}
+		if gotPat != pat {
+			t.Errorf("unexpected pattern for %s; got %p want %p", method, gotPat, pat)
+		}
+	}
+	h, _, _ := r.HandlerToUse("PUT", "/a/1")
+	if _, ok := h.(hroute.MethodNotAllowed); !ok {
+		t.Errorf("unexpected handler for PUT; got %#v", h)
+	}
+
+	expectPanic := func(want string, f func()) {
+		defer func() {
+			if got := fmt.Sprint(recover()); got != want {
+				t.Errorf("unexpected panic; got %q want %q", got, want)
+			}
+		}()
+		f()
+	}
+	expectPanic(`duplicate method "GET" in methods for "/b"`, func() {
+		r.Handles([]string{"GET", "POST", "GET"}, "/b", nopHandler("b"))
+	})
+	expectPanic("duplicate route", func() {
+		r.Handles([]string{"PUT", "POST"}, "/a/:x", nopHandler("a"))
+	})
+	// The failed call must not have registered PUT.
+	h, _, _ = r.HandlerToUse("PUT", "/a/1")
+	if _, ok := h.(hroute.MethodNotAllowed); !ok {
+		t.Errorf("unexpected handler for PUT after failed registration; got %#v", h)
+	}
+}
+
+func TestConflictingCatchAllNames(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a/*foo", nopHandler("foo"))
+	// The same name is fine for a different method.
+	r.Handle("POST", "/a/*foo", nopHandler("foo"))
+	defer func() {
+		want := `catch-all *bar in "/a/*bar" conflicts with *foo in existing pattern "/a/*foo"`
+		if got := fmt.Sprint(recover()); got != want {
+			t.Errorf("unexpected panic; got %q want %q", got, want)
+		}
+	}()
+	r.Handle("PUT", "/a/*bar", nopHandler("bar"))
+}
+
+func TestEnableDynamicRoutes(t *testing.T) {
+	ok := hroute.HandlerFunc(func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	r := hroute.New()
+	r.Handle("GET", "/a/:x", ok)
+	r.EnableDynamicRoutes()
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			r.Handle("GET", fmt.Sprintf("/b%d/:x", i), ok)
+		}
+		for i := 0; i < n; i += 2 {
+			r.Remove("GET", fmt.Sprintf("/b%d/:x", i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n*4; i++ {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, mustNewRequest("GET", "/a/1"))
+			if rec.Code != http.StatusOK {
+				t.Errorf("unexpected status %d", rec.Code)
+				return
+			}
+			r.ServeHTTP(httptest.NewRecorder(), mustNewRequest("GET", fmt.Sprintf("/b%d/1", i%n)))
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, mustNewRequest("GET", fmt.Sprintf("/b%d/x", i)))
+		want := http.StatusOK
+		if i%2 == 0 {
+			want = http.StatusNotFound
+		}
+		if rec.Code != want {
+			t.Errorf("/b%d/x: unexpected status; got %d want %d", i, rec.Code, want)
+		}
+	}
+
+	// A registration that fails leaves the tree unchanged.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+		r.Handles([]string{"PUT", "GET"}, "/a/:x", nopHandler("a"))
+	}()
+	if res := r.Lookup("PUT", "/a/1"); res.Handler != nil {
+		t.Errorf("unexpected PUT route after failed registration")
+	}
+}
+
+func TestDynamicRoutesLocalized(t *testing.T) {
+	r := hroute.New()
+	r.EnableDynamicRoutes()
+	const n = 50
+	for i := 0; i < n; i++ {
+		r.HandleLocalized(fmt.Sprint("r", i), map[string]string{
+			"en": fmt.Sprintf("/en%d/:x", i),
+			"fr": fmt.Sprintf("/fr%d/:x", i),
+		}, "GET", nopHandler("x"))
+	}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			r.Remove("GET", fmt.Sprintf("/fr%d/:x", i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			r.HandleLocalized(fmt.Sprint("new", i), map[string]string{
+				"en": fmt.Sprintf("/new%d/:x", i),
+			}, "GET", nopHandler("x"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if _, err := r.URLLocalized(fmt.Sprint("r", i), "en", "x", "1"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			r.URLLocalized(fmt.Sprint("r", i), "fr", "x", "1")
+		}
+	}()
+	wg.Wait()
+	if _, err := r.URLLocalized("r0", "fr", "x", "1"); err == nil {
+		t.Errorf("expected error for removed locale")
+	}
+}
+
+func TestClone(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a", pathHandler{"GET", "/a"})
+	r.Handle("GET", "/b/:x", pathHandler{"GET", "/b/:x"}, hroute.WithName("b"))
+	r.Host("example.com").Handle("GET", "/h", pathHandler{"GET", "/h"})
+	r.NotFoundByMethod = map[string]hroute.Handler{"POST": nopHandler("post")}
+	r.Freeze()
+
+	r1 := r.Clone()
+	r1.Handle("GET", "/c", pathHandler{"GET", "/c"})
+	r1.Remove("GET", "/a")
+	r1.Host("example.com").Handle("GET", "/h2", pathHandler{"GET", "/h2"})
+	r1.NotFoundByMethod["PUT"] = nopHandler("put")
+
+	for _, test := range []struct {
+		r           *hroute.Router
+		path        string
+		expectFound bool
+	}{
+		{r, "/a", true},
+		{r, "/b/1", true},
+		{r, "/c", false},
+		{r1, "/a", false},
+		{r1, "/b/1", true},
+		{r1, "/c", true},
+	} {
+		_, _, pat := test.r.HandlerToUse("GET", test.path)
+		if found := pat != nil; found != test.expectFound {
+			t.Errorf("%s on router %p: found %v want %v", test.path, test.r, found, test.expectFound)
+		}
+	}
+	if got, want := len(r.Routes()), 3; got != want {
+		t.Errorf("unexpected route count in original; got %d want %d", got, want)
+	}
+	if got, want := len(r1.Routes()), 4; got != want {
+		t.Errorf("unexpected route count in clone; got %d want %d", got, want)
+	}
+	if _, ok := r.NotFoundByMethod["PUT"]; ok {
+		t.Errorf("NotFoundByMethod shared with clone")
+	}
+	if path, err := r1.URL("b", "x", "2"); err != nil || path != "/b/2" {
+		t.Errorf("unexpected URL from clone; got %q, %v", path, err)
+	}
+}
+
+func TestPass(t *testing.T) {
+	r := hroute.New()
+	var tried []string
+	handler := func(name string, pass func(p hroute.Params) bool) hroute.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			tried = append(tried, name)
+			if pass(p) {
+				panic(hroute.ErrPass)
+			}
+			w.Write([]byte(name))
+		}
+	}
+	r.Handle("GET", "/:id(\\d+)", handler("num", func(p hroute.Params) bool {
+		return p.Get("id") == "0"
+	}))
+	r.Handle("GET", "/:id", handler("id", func(p hroute.Params) bool {
+		return strings.HasPrefix(p.Get("id"), "x")
+	}))
+	r.Handle("GET", "/*path", handler("catchall", func(p hroute.Params) bool {
+		return p.Get("path") == "/xx"
+	}))
+	for _, test := range []struct {
+		path        string
+		expectTried []string
+		expectCode  int
+		expectBody  string
+	}{{
+		path:        "/1",
+		expectTried: []string{"num"},
+		expectCode:  http.StatusOK,
+		expectBody:  "num",
+	}, {
+		path:        "/0",
+		expectTried: []string{"num", "id"},
+		expectCode:  http.StatusOK,
+		expectBody:  "id",
+	}, {
+		path:        "/x",
+		expectTried: []string{"id", "catchall"},
+		expectCode:  http.StatusOK,
+		expectBody:  "catchall",
+	}, {
+		path:        "/xx",
+		expectTried: []string{"id", "catchall"},
+		expectCode:  http.StatusNotFound,
+		expectBody:  "404 page not found\n",
+	}} {
+		tried = nil
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, mustNewRequest("GET", test.path))
+		if !reflect.DeepEqual(tried, test.expectTried) {
+			t.Errorf("%s: unexpected handlers tried; got %q want %q", test.path, tried, test.expectTried)
+		}
+		if rec.Code != test.expectCode {
+			t.Errorf("%s: unexpected status; got %d want %d", test.path, rec.Code, test.expectCode)
+		}
+		if got := rec.Body.String(); got != test.expectBody {
+			t.Errorf("%s: unexpected body; got %q want %q", test.path, got, test.expectBody)
+		}
+	}
+}
+
+func TestPassMiddleware(t *testing.T) {
+	r := hroute.New()
+	var calls []string
+	r.Use(func(h hroute.Handler) hroute.Handler {
+		return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			calls = append(calls, "router")
+			h.ServeRoute(w, req, p)
+		})
+	})
+	routeMiddleware := func(name string) hroute.RouteOption {
+		return hroute.WithMiddleware(func(h hroute.Handler) hroute.Handler {
+			return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+				calls = append(calls, name)
+				h.ServeRoute(w, req, p)
+			})
+		})
+	}
+	r.HandleFunc("GET", "/:id(\\d+)", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		panic(hroute.ErrPass)
+	}, routeMiddleware("num"))
+	r.HandleFunc("GET", "/:id", func(w http.ResponseWriter, req *http.Request, _ hroute.Params) {
+		w.Write([]byte("id"))
+	}, routeMiddleware("id"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("GET", "/1"))
+	if got, want := rec.Body.String(), "id"; got != want {
+		t.Fatalf("unexpected body; got %q want %q", got, want)
+	}
+	if want := []string{"router", "num", "id"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("unexpected middleware calls; got %q want %q", calls, want)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/existing", nopHandler("existing"))
+	pats, err := r.Add([]hroute.Route{{
+		Method:  "GET",
+		Pattern: "/a/:id",
+		Handler: nopHandler("a"),
+	}, {
+		Method:  "GET",
+		Pattern: "/b/*rest/c",
+		Handler: nopHandler("b"),
+	}, {
+		Method:  "PUT",
+		Pattern: "/c",
+		Handler: nopHandler("c"),
+		Options: []hroute.RouteOption{hroute.WithName("c")},
+	}, {
+		Method:  "GET",
+		Pattern: "/existing",
+		Handler: nopHandler("dup"),
+	}})
+	want := `route 1 (GET "/b/*rest/c"): cannot parse pattern "/b/*rest/c": catch-all route not at end of path` + "\n" +
+		`route 3 (GET "/existing"): duplicate route`
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error; got %v want %q", err, want)
+	}
+	var got []string
+	for _, pat := range pats {
+		if pat == nil {
+			got = append(got, "")
+		} else {
+			got = append(got, pat.String())
+		}
+	}
+	if want := []string{"/a/:id", "", "/c", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected patterns; got %q want %q", got, want)
+	}
+	if res := r.Lookup("GET", "/a/1"); res.Handler != nopHandler("a") {
+		t.Errorf("unexpected handler for /a/1; got %#v", res.Handler)
+	}
+	if res := r.Lookup("PUT", "/c"); res.Handler != nopHandler("c") {
+		t.Errorf("unexpected handler for /c; got %#v", res.Handler)
+	}
+	if u, err := r.URL("c"); err != nil || u != "/c" {
+		t.Errorf("unexpected URL for named route; got %q, %v", u, err)
+	}
+
+	var perr *hroute.PatternError
+	if !errors.As(err, &perr) || perr.Pattern != "/b/*rest/c" || perr.Offset != 3 || !errors.Is(err, hroute.ErrCatchAllNotAtEnd) {
+		t.Errorf("error from Add does not wrap the pattern error; got %#v", perr)
+	}
+
+	pat, err := r.HandleError("GET", "/a/../b", nopHandler("x"))
+	if pat != nil || err == nil {
+		t.Fatalf("expected error from HandleError; got %v, %v", pat, err)
+	}
+	if !errors.Is(err, hroute.ErrNotClean) || !errors.As(err, &perr) || perr.Pattern != "/a/../b" {
+		t.Errorf("error from HandleError does not wrap the pattern error; got %#v", err)
+	}
+	if _, err := r.Add(nil); err != nil {
+		t.Errorf("unexpected error adding no routes: %v", err)
+	}
+}
+
+func TestAddConflictLeavesRouterUnchanged(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", "/a/", nopHandler("a/"))
+	r.Handle("GET", "/b/*rest", nopHandler("rest"))
+	before := r.String()
+	pats, err := r.Add([]hroute.Route{{
+		// The variant of the pattern, /a/, is already registered.
+		Method:  "GET",
+		Pattern: "/a{/}",
+		Handler: nopHandler("a"),
+	}, {
+		// The catch-all has a different name.
+		Method:  "PUT",
+		Pattern: "/b/*other",
+		Handler: nopHandler("other"),
+	}})
+	if err == nil || pats[0] != nil || pats[1] != nil {
+		t.Fatalf("expected errors; got %v, %v", pats, err)
+	}
+	if got, want := r.String(), before; got != want {
+		t.Errorf("router changed by failed registration; got %q want %q", got, want)
+	}
+	if res := r.Lookup("GET", "/a"); res.Handler == nopHandler("a") {
+		t.Errorf("route registered despite error")
+	}
+	if r.Remove("GET", "/a") || r.Remove("GET", "/a{/}") {
+		t.Errorf("unexpected removal of route that was not registered")
+	}
+	if res := r.Lookup("PUT", "/b/x"); res.Handler != nil {
+		t.Errorf("unexpected PUT route after failed registration")
+	}
+	if got, want := len(r.Routes()), 2; got != want {
+		t.Errorf("unexpected route count; got %d want %d", got, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	r := hroute.New()
+	if got, want := r.Stats(), (hroute.Stats{Nodes: 1, MaxDepth: 1}); got != want {
+		t.Errorf("unexpected stats for empty router; got %+v want %+v", got, want)
+	}
+	r.Handle("GET", "/a", nopHandler("a"))
+	r.Handle("PUT", "/a", nopHandler("a"))
+	r.Handle("GET", "/ab/:x/:y", nopHandler("ab"))
+	r.Handle("GET", "/files/*path", nopHandler("files"))
+	r.Host("example.com").Handle("GET", "/b", nopHandler("b"))
+	// The tree holds "/" -> "a" -> "b/" -> :x -> "/" -> :y
+	// and "/" -> "files/" -> *path in the main tree
+	// and "/b" in the host tree.
+	want := hroute.Stats{
+		Routes:    5,
+		Nodes:     10,
+		MaxDepth:  6,
+		MaxParams: 2,
+	}
+	if got := r.Stats(); got != want {
+		t.Errorf("unexpected stats; got %+v want %+v", got, want)
+	}
+}
+
+func TestCatchAllNoLeadingSlash(t *testing.T) {
+	r := hroute.New()
+	r.CatchAllNoLeadingSlash = true
+	pat := r.Handle("GET", "/static/*path", nopHandler("static"))
+	sub := hroute.New()
+	sub.HandleFunc("GET", "/x", func(http.ResponseWriter, *http.Request, hroute.Params) {})
+	r.Handle("GET", "/sub/*rest", sub)
+	for _, test := range []struct {
+		path        string
+		expectValue string
+	}{
+		{"/static/css/app.css", "css/app.css"},
+		{"/static/", ""},
+	} {
+		res := r.Lookup("GET", test.path)
+		if res.Pattern != pat {
+			t.Fatalf("%s: unexpected pattern %v", test.path, res.Pattern)
+		}
+		if got := res.Params.Get("path"); got != test.expectValue {
+			t.Errorf("%s: unexpected value; got %q want %q", test.path, got, test.expectValue)
+		}
+		got, err := pat.PathWithParams(res.Params)
+		if err != nil || got != test.path {
+			t.Errorf("%s: unexpected reverse path; got %q, %v", test.path, got, err)
+		}
+	}
+	if _, err := pat.Path("/css/app.css"); err == nil || err.Error() != "catch-all parameter with / prefix" {
+		t.Errorf("unexpected error from Path with leading slash: %v", err)
+	}
+
+	// A router registered on a catch-all route still sees
+	// a path with a leading slash.
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, mustNewRequest("GET", "/sub/x"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status from subrouter; got %d", rec.Code)
+	}
+
+	// The default is unchanged.
+	r = hroute.New()
+	r.Handle("GET", "/static/*path", nopHandler("static"))
+	if got := r.Lookup("GET", "/static/css/app.css").Params.Get("path"); got != "/css/app.css" {
+		t.Errorf("unexpected default value; got %q", got)
+	}
+}
+
+func TestNotFoundFor(t *testing.T) {
+	r := hroute.New()
+	r.NotFound = nopHandler("global")
+	r.Handle("GET", "/api/users", nopHandler("users"))
+	r.NotFoundFor("/api", nopHandler("api"))
+	r.NotFoundFor("/api/v2/", nopHandler("v2"))
+	r.NotFoundFor("/api/v1", nopHandler("old"))
+	r.NotFoundFor("/api/v1", nopHandler("v1"))
+	for _, test := range []struct {
+		path          string
+		expectHandler hroute.Handler
+	}{
+		{"/api", nopHandler("api")},
+		{"/api/other", nopHandler("api")},
+		{"/api/v1/x", nopHandler("v1")},
+		{"/api/v12", nopHandler("api")},
+		{"/api/v2/x", nopHandler("v2")},
+		{"/apis", nopHandler("global")},
+		{"/other", nopHandler("global")},
+		{"/api/users", nopHandler("users")},
+	} {
+		h, _, _ := r.HandlerToUse("GET", test.path)
+		if h != test.expectHandler {
+			t.Errorf("%s: unexpected handler; got %#v want %#v", test.path, h, test.expectHandler)
+		}
+	}
+}
+
+func TestCheckContextCancel(t *testing.T) {
+	called := 0
+	inner := hroute.New()
+	inner.CheckContextCancel = true
+	inner.HandleFunc("GET", "/x", func(http.ResponseWriter, *http.Request, hroute.Params) {
+		called++
+	})
+	r := hroute.New()
+	r.Handle("GET", "/sub/*rest", inner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := mustNewRequest("GET", "/sub/x").WithContext(ctx)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || called != 1 {
+		t.Fatalf("unexpected result before cancel; status %d, called %d", rec.Code, called)
+	}
+
+	cancel()
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status after cancel; got %d want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if called != 1 {
+		t.Errorf("handler called after cancel")
+	}
+
+	// Without CheckContextCancel, the handler is still called.
+	inner.CheckContextCancel = false
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || called != 2 {
+		t.Errorf("unexpected result without check; status %d, called %d", rec.Code, called)
+	}
+}
+
+func TestHandleAround(t *testing.T) {
+	var log []string
+	handler := func(name string) hroute.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			log = append(log, name+" "+p.Get("id"))
+		}
+	}
+	wrap := func(name string) func(hroute.Handler) hroute.Handler {
+		return func(h hroute.Handler) hroute.Handler {
+			return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+				log = append(log, name)
+				h.ServeRoute(w, req, p)
+			})
+		}
+	}
+	r := hroute.New()
+	r.HandleAround("*", "/items/:id", wrap("auth"))
+	r.Handle("GET", "/items/:id", handler("get"))
+	r.Handle("PUT", "/items/:id", handler("put"))
+	r.HandleAny("/items/:id", handler("any"))
+	r.HandleAround("PUT", "/items/:id", wrap("audit"))
+	r.Handle("GET", "/items/:id/*rest", handler("rest"))
+	for _, test := range []struct {
+		method    string
+		path      string
+		expectLog []string
+	}{
+		{"GET", "/items/1", []string{"auth", "get 1"}},
+		{"PUT", "/items/2", []string{"auth", "audit", "put 2"}},
+		{"POST", "/items/3", []string{"auth", "any 3"}},
+		{"GET", "/items/4/x", []string{"rest 4"}},
+	} {
+		log = nil
+		r.ServeHTTP(httptest.NewRecorder(), mustNewRequest(test.method, test.path))
+		if !reflect.DeepEqual(log, test.expectLog) {
+			t.Errorf("%s %s: unexpected log; got %q want %q", test.method, test.path, log, test.expectLog)
+		}
+	}
+	// HandleAround does not add a route by itself.
+	r.HandleAround("*", "/other", wrap("other"))
+	if h, _, _ := r.Handler("GET", "/other"); h != nil {
+		t.Errorf("unexpected handler for /other: %#v", h)
+	}
+}
+
+func TestHandleAroundWithCatchAll(t *testing.T) {
+	var log []string
+	r := hroute.New()
+	r.HandleFunc("GET", "/a/*rest", func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+		log = append(log, "rest "+p.Get("rest"))
+	})
+	r.HandleAround("*", "/a/:id", func(h hroute.Handler) hroute.Handler {
+		return hroute.HandlerFunc(func(w http.ResponseWriter, req *http.Request, p hroute.Params) {
+			log = append(log, "around")
+			h.ServeRoute(w, req, p)
+		})
+	})
+	r.HandleAround("*", "/a/b/c", func(h hroute.Handler) hroute.Handler {
+		return h
+	})
+	for _, path := range []string{"/a/x", "/a/b", "/a/b/c"} {
+		log = nil
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, mustNewRequest("GET", path))
+		if got, want := w.Code, http.StatusOK; got != want {
+			t.Errorf("unexpected status for %q; got %d want %d", path, got, want)
+		}
+		if want := []string{"rest " + path[len("/a"):]}; !reflect.DeepEqual(log, want) {
+			t.Errorf("unexpected log for %q; got %q want %q", path, log, want)
+		}
+	}
+
+	if r.Remove("*", "/a/:id") {
+		t.Errorf("Remove removed middleware")
+	}
+	if !r.RemoveAround("*", "/a/:id") || !r.RemoveAround("*", "/a/b/c") {
+		t.Fatalf("cannot remove middleware")
+	}
+	if r.RemoveAround("*", "/a/:id") {
+		t.Errorf("middleware removed twice")
+	}
+	r1 := hroute.New()
+	r1.Handle("GET", "/a/*rest", nopHandler("rest"))
+	if got, want := r.Stats().Nodes, r1.Stats().Nodes; got != want {
+		t.Errorf("unexpected node count after removing middleware; got %d want %d", got, want)
+	}
+}
+
+func TestRoutesUnder(t *testing.T) {
+	r := hroute.New()
+	for _, p := range []string{"/users", "/users/:id", "/users/:id/posts", "/usersearch", "/user", "/files/*path", "/"} {
+		r.Handle("GET", p, nopHandler(p))
+	}
+	r.Host("example.com").Handle("GET", "/users/me", nopHandler("me"))
+	for _, test := range []struct {
+		prefix       string
+		expectRoutes []string
+	}{
+		{"/users/", []string{"/users/:id", "/users/:id/posts", "example.com /users/me"}},
+		{"/users", []string{"/users", "/users/:id", "/users/:id/posts", "/usersearch", "example.com /users/me"}},
+		{"/use", []string{"/user", "/users", "/users/:id", "/users/:id/posts", "/usersearch", "example.com /users/me"}},
+		{"/files/", []string{"/files/*path"}},
+		{"/nothing", nil},
+		{"/users/x", nil},
+	} {
+		var got []string
+		for _, rt := range r.RoutesUnder(test.prefix) {
+			s := rt.Pattern.String()
+			if rt.Host != "" {
+				s = rt.Host + " " + s
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, test.expectRoutes) {
+			t.Errorf("%q: unexpected routes; got %q want %q", test.prefix, got, test.expectRoutes)
+		}
+	}
+	if got, want := len(r.RoutesUnder("/")), len(r.Routes()); got != want {
+		t.Errorf("unexpected route count for /; got %d want %d", got, want)
+	}
+	defer func() {
+		want := `route prefix "/users/:id" contains a wildcard`
+		if got := fmt.Sprint(recover()); got != want {
+			t.Errorf("unexpected panic; got %q want %q", got, want)
+		}
+	}()
+	r.RoutesUnder("/users/:id")
+}
+
+func TestEscapedPattern(t *testing.T) {
+	r := hroute.New()
+	r.Handle("GET", `/emoji/\:)`, pathHandler{"GET", "smile"})
+	r.Handle("GET", "/emoji/:name", pathHandler{"GET", "name"})
+	r.Handle("GET", `/time/:h\:\::m`, pathHandler{"GET", "time"})
+	for _, test := range []struct {
+		path          string
+		expectHandler hroute.Handler
+		expectParams  hroute.Params
+	}{
+		{"/emoji/:)", pathHandler{"GET", "smile"}, nil},
+		{"/emoji/x", pathHandler{"GET", "name"}, hroute.Params{{"name", "x"}}},
+		{"/time/10::30", pathHandler{"GET", "time"}, hroute.Params{{"h", "10"}, {"m", "30"}}},
+	} {
+		h, ps, _ := r.Handler("GET", test.path)
+		if h != test.expectHandler {
+			t.Errorf("%s: unexpected handler; got %#v want %#v", test.path, h, test.expectHandler)
+		}
+		if len(ps) == 0 {
+			ps = nil
+		}
+		if !reflect.DeepEqual(ps, test.expectParams) {
+			t.Errorf("%s: unexpected params; got %#v want %#v", test.path, ps, test.expectParams)
+		}
+	}
+	if got := len(r.RoutesUnder(`/emoji/\:`)); got != 1 {
+		t.Errorf("unexpected number of routes under escaped prefix; got %d want 1", got)
+	}
+}
@@ -0,0 +1,78 @@
+package hroute
+
+import "strings"
+
+// swapSeparator returns s with each occurrence of sep replaced by '/'
+// and each '/' replaced by sep. Because the exchange is symmetric,
+// it converts between a path that uses sep to separate segments and
+// the '/'-separated form used by the routing tree in either
+// direction. If sep is zero or '/', s is returned unchanged.
+func swapSeparator(s string, sep byte) string {
+	if sep == 0 || sep == '/' {
+		return s
+	}
+	if strings.IndexByte(s, sep) == -1 && strings.IndexByte(s, '/') == -1 {
+		return s
+	}
+	buf := []byte(s)
+	for i, c := range buf {
+		switch c {
+		case sep:
+			buf[i] = '/'
+		case '/':
+			buf[i] = sep
+		}
+	}
+	return string(buf)
+}
+
+// separator returns the byte that separates segments in
+// the router's paths.
+func (r *Router) separator() byte {
+	if r.Separator == 0 {
+		return '/'
+	}
+	return r.Separator
+}
+
+// fromTree converts the values of the parameters in ps and the target
+// of any redirect in h from the '/'-separated form used by the
+// routing tree to the router's separator. If the parameters are for
+// a catch-all route in entry e and r.CatchAllNoLeadingSlash is set,
+// the leading slash is removed from the catch-all value.
+func (r *Router) fromTree(h Handler, e *handlerEntry, ps Params) (Handler, Params) {
+	if r.CatchAllNoLeadingSlash && e != nil && e.pattern.catchAll && len(ps) > 0 {
+		last := &ps[len(ps)-1]
+		last.Value = strings.TrimPrefix(last.Value, "/")
+	}
+	for i := range ps {
+		ps[i].Value = swapSeparator(ps[i].Value, r.Separator)
+	}
+	if rd, ok := h.(Redirect); ok {
+		path, query, hasQuery := strings.Cut(rd.Path, "?")
+		rd.Path = swapSeparator(path, r.Separator)
+		if hasQuery {
+			rd.Path += "?" + query
+		}
+		h = rd
+	}
+	return h, ps
+}
+
+// parsePattern parses a pattern registered with the router,
+// taking the router's separator and CatchAllNoLeadingSlash
+// into account.
+func (r *Router) parsePattern(pattern string) (*Pattern, error) {
+	pat, err := ParsePattern(swapSeparator(pattern, r.Separator))
+	if err != nil {
+		if perr, ok := err.(*PatternError); ok {
+			perr.Pattern = pattern
+		}
+		return nil, err
+	}
+	if r.Separator != '/' {
+		pat.sep = r.Separator
+	}
+	pat.catchAllNoSlash = r.CatchAllNoLeadingSlash
+	return pat, nil
+}
@@ -0,0 +1,68 @@
+package hroute_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestSeparator(t *testing.T) {
+	r := hroute.New()
+	r.Separator = '.'
+	r.Handle("GET", ".a.b", pathHandler{"GET", ".a.b"})
+	r.Handle("GET", ".a.:x.c", pathHandler{"GET", ".a.:x.c"})
+	r.Handle("GET", ".files.*rest", pathHandler{"GET", ".files.*rest"})
+	for _, test := range []struct {
+		path          string
+		expectPattern string
+		expectParams  hroute.Params
+	}{{
+		path:          ".a.b",
+		expectPattern: ".a.b",
+	}, {
+		path:          ".a.x/y.c",
+		expectPattern: ".a.:x.c",
+		expectParams:  hroute.Params{{"x", "x/y"}},
+	}, {
+		path:          ".files.d.e",
+		expectPattern: ".files.*rest",
+		expectParams:  hroute.Params{{"rest", ".d.e"}},
+	}} {
+		h, ps, pat := r.Handler("GET", test.path)
+		if pat == nil {
+			t.Errorf("no route found for %q", test.path)
+			continue
+		}
+		if got := pat.String(); got != test.expectPattern {
+			t.Errorf("%q: unexpected pattern; got %q want %q", test.path, got, test.expectPattern)
+		}
+		if want := (pathHandler{"GET", test.expectPattern}); h != want {
+			t.Errorf("%q: unexpected handler; got %#v want %#v", test.path, h, want)
+		}
+		if len(ps) == 0 {
+			ps = nil
+		}
+		if !reflect.DeepEqual(ps, test.expectParams) {
+			t.Errorf("%q: unexpected params; got %#v want %#v", test.path, ps, test.expectParams)
+		}
+		got, err := pat.PathWithParams(ps)
+		if err != nil {
+			t.Fatalf("%q: %v", test.path, err)
+		}
+		if got != test.path {
+			t.Errorf("unexpected reverse path; got %q want %q", got, test.path)
+		}
+	}
+
+	// A path with a trailing separator is redirected as usual.
+	target, _, ok := r.RedirectTarget("GET", ".a.b.")
+	if !ok || target != ".a.b" {
+		t.Errorf("unexpected redirect target; got %q, %v want %q", target, ok, ".a.b")
+	}
+
+	// Slashes are not separators.
+	if _, _, pat := r.Handler("GET", "/a/b"); pat != nil {
+		t.Errorf("unexpected match for slash-separated path: %v", pat)
+	}
+}
@@ -2,7 +2,12 @@ package hroute
 
 import (
 	"bytes"
+	"errors"
+	"net/http"
+	"sort"
 	"strings"
+
+	"gopkg.in/errgo.v1"
 )
 
 type node struct {
@@ -13,13 +18,35 @@ type node struct {
 	// firstBytes holds the first byte of the path
 	// segment for each child. The path segment
 	// of the child does not include the byte held
-	// here.
+	// here. It is kept sorted so that childIndex
+	// can use a binary search when there are many
+	// children.
 	firstBytes []byte
 	child      []*node
 
+	// inSegmentChild holds whether any child's path segment
+	// starts with a byte other than '/'. When n is a
+	// wildcard node, this means that its value may end before
+	// the end of the path element, as in ":name.:ext".
+	inSegmentChild bool
+
 	// wild holds any wildcard node that descends from here.
 	wild *node
 
+	// constrained holds any wildcard nodes with constraints
+	// that descend from here, in the order they were added.
+	// They are tried before wild.
+	constrained []*node
+
+	// constraint holds the constraint on the wildcard
+	// value when the node is held in its parent's
+	// constrained slice.
+	constraint *constraint
+
+	// multi holds any multi-segment wildcard node that descends
+	// from here. It is always followed by a static segment.
+	multi *node
+
 	// catchAll holds any final catchAll node that descends from
 	// here. Note that it will always be a leaf if present.
 	catchAll *node
@@ -27,6 +54,18 @@ type node struct {
 	// handlers holds the handlers registered for this node.
 	// There is at most one entry for a given method.
 	handlers []handlerEntry
+
+	// around holds the entries registered for this node with
+	// Router.HandleAround, in registration order. They wrap
+	// the handler of whichever entry in handlers is chosen.
+	around []handlerEntry
+
+	// maxParams holds the maximum number of parameters
+	// matched by this node and its descendants in any route
+	// that passes through it. This is used to allocate
+	// only as many parameters as the branch of the tree
+	// being looked up can need.
+	maxParams int
 }
 
 type handlerEntry struct {
@@ -40,31 +79,122 @@ type handlerEntry struct {
 
 	// pattern holds the pattern that was used to register the entry.
 	pattern *Pattern
+
+	// opts holds any options specified when the
+	// entry was registered.
+	opts RouteOptions
+
+	// variant holds whether this entry serves an alternative
+	// form of its pattern: the trailing-slash form of a pattern
+	// ending in "{/}", or the form without the final wildcard of
+	// a pattern ending in an optional wildcard. Such entries are
+	// not visited by walk.
+	variant bool
+
+	// around holds the middleware registered with
+	// Router.HandleAround; if it is non-nil, handler
+	// is nil and the entry is held in node.around.
+	around func(Handler) Handler
+}
+
+func (n *node) addRoute(pat *Pattern, e handlerEntry) {
+	n.addPattern(pat, e)
+	if variant := pat.variant(); variant != nil {
+		e.variant = true
+		n.addPattern(variant, e)
+	}
 }
 
-func (n *node) addRoute(pat *Pattern, method string, h Handler) {
+// addPattern adds the entry e at the position in the tree
+// given by pat, which is either e.pattern or its variant.
+func (n *node) addPattern(pat *Pattern, e handlerEntry) {
 	var prefix string
 	pat1 := *pat
 	prefix, pat1.static = pat1.static[0], pat1.static[1:]
-	n.addStaticPrefix(prefix, &pat1, method, h, pat)
+	n.addStaticPrefix(prefix, &pat1, e)
 }
 
-func (n *node) entryForMethod(method string) *handlerEntry {
+// entryForMethod returns the entry that should be used to
+// serve the given method. If req is nil, request-dependent
+// route options are not taken into account. Entries
+// for patterns in exclude are ignored.
+func (n *node) entryForMethod(method string, req *http.Request, exclude []*Pattern) *handlerEntry {
 	for i := range n.handlers {
 		e := &n.handlers[i]
-		if e.method == "*" || e.method == method {
+		if (e.method == "*" || e.method == method) && (req == nil || e.opts.matchRequest(req)) && !isExcluded(e.pattern, exclude) {
 			return e
 		}
 	}
 	return nil
 }
 
+// excluded reports whether n has handlers but all
+// of them are for patterns in exclude.
+func (n *node) excluded(exclude []*Pattern) bool {
+	if len(exclude) == 0 || len(n.handlers) == 0 {
+		return false
+	}
+	for i := range n.handlers {
+		if !isExcluded(n.handlers[i].pattern, exclude) {
+			return false
+		}
+	}
+	return true
+}
+
+// isExcluded reports whether p is one of the patterns in exclude.
+func isExcluded(p *Pattern, exclude []*Pattern) bool {
+	for _, p1 := range exclude {
+		if p1 == p {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the methods registered in n,
+// sorted and suitable for use in an Allow header.
+// If extra is non-empty, it is included too.
+func (n *node) allowedMethods(extra string) []string {
+	methods := make([]string, 0, len(n.handlers)+1)
+	if extra != "" {
+		methods = append(methods, extra)
+	}
+	for _, e := range n.handlers {
+		if e.method == "*" {
+			continue
+		}
+		if i := sort.SearchStrings(methods, e.method); i == len(methods) || methods[i] != e.method {
+			methods = append(methods, "")
+			copy(methods[i+1:], methods[i:])
+			methods[i] = e.method
+		}
+	}
+	return methods
+}
+
+// rank returns the position of the entry relative to
+// other entries in the same node. Entries with a lower
+// rank are considered first.
+func (e *handlerEntry) rank() int {
+	rank := 0
+	if e.method == "*" {
+		rank += 2
+	}
+	if !e.opts.constrained() {
+		rank++
+	}
+	return rank
+}
+
 // addStaticPrefix adds a route to the given node for the given static
 // prefix. The given pattern holds the remaining elements of the pattern
 // we're adding and all the variable names defined by the pattern.
+// The entry holds the handler to register; its pattern field
+// holds the original pattern.
 //
 // Precondition: pat.static is either empty or its first element is empty.
-func (n *node) addStaticPrefix(prefix string, pat *Pattern, method string, h Handler, origPat *Pattern) {
+func (n *node) addStaticPrefix(prefix string, pat *Pattern, e handlerEntry) {
 	common := commonPrefix(prefix, n.path)
 	if len(common) < len(n.path) {
 		// This node's prefix is too long; split it,
@@ -72,16 +202,23 @@ func (n *node) addStaticPrefix(prefix string, pat *Pattern, method string, h Han
 		n1 := *n
 		childPrefix := n.path[len(common):]
 		n1.path = childPrefix[1:]
+		n1.constraint = nil
 		*n = node{
-			path: common,
+			path:       common,
+			constraint: n.constraint,
+			maxParams:  n.maxParams,
 		}
 		n.addChild(childPrefix[0], &n1)
 	}
 	// Invariant: common == n.path
+	// From the precondition, the number of variables
+	// remaining is the number of odd positions in pat.static.
+	// The parameters for named groups are added after them.
+	n.noteParams((len(pat.static)+1)/2 + e.pattern.numGroups())
 	if len(common) < len(prefix) {
 		// More to go.
 		prefix = prefix[len(common):]
-		i := bytes.IndexByte(n.firstBytes, prefix[0])
+		i := n.childIndex(prefix[0])
 		if i == -1 {
 			// No child found, so make a new one.
 			i = n.addChild(prefix[0], &node{
@@ -89,71 +226,503 @@ func (n *node) addStaticPrefix(prefix string, pat *Pattern, method string, h Han
 			})
 		}
 		// Descend further into the tree.
-		n.child[i].addStaticPrefix(prefix[1:], pat, method, h, origPat)
+		n.child[i].addStaticPrefix(prefix[1:], pat, e)
 		return
 	}
 	// Invariant: common == prefix
 	if len(pat.static) == 0 {
 		// We've arrived at our destination.
-		n.setHandler(method, h, origPat)
+		n.setHandler(e)
 		return
 	}
-	// We're adding a wildcard, which might be a single segment or a
-	// final catch-all segment.
+	// We're adding a wildcard, which might be a single segment,
+	// multiple segments or a final catch-all segment.
 	wildPt := &n.wild
+	v := len(pat.vars) - (len(pat.static)+1)/2
 	if len(pat.static) == 1 && pat.catchAll {
 		wildPt = &n.catchAll
+	} else if pat.isMulti(v) {
+		wildPt = &n.multi
+	} else if c := pat.constraintAt(v); c != nil {
+		wildPt = n.constrainedSlot(c)
 	}
 	if *wildPt == nil {
 		// No existing wildcard node, so add one.
 		*wildPt = new(node)
+	} else if wildPt == &n.catchAll {
+		// All the routes in a catch-all node must use the
+		// same name for it, as otherwise the value would have
+		// a different meaning depending on the method.
+		checkCatchAllName(*wildPt, e.pattern)
 	}
 	n = *wildPt
+	n.noteParams((len(pat.static)+1)/2 + e.pattern.numGroups())
 	pat.static = pat.static[1:]
 	// Invariant: pat.static is either empty or its first element is non-empty.
 	if len(pat.static) == 0 {
 		// We've reached our destination.
-		n.setHandler(method, h, origPat)
+		n.setHandler(e)
 		return
 	}
 	// Descend further into the tree
 	prefix = pat.static[0]
 	pat.static = pat.static[1:]
-	n.addStaticPrefix(prefix, pat, method, h, origPat)
+	n.addStaticPrefix(prefix, pat, e)
+}
+
+// clone returns a deep copy of the tree rooted at n.
+// The handler entries are copied but their patterns,
+// handlers and options are shared.
+func (n *node) clone() *node {
+	n1 := *n
+	n1.firstBytes = append([]byte(nil), n.firstBytes...)
+	n1.child = cloneNodes(n.child)
+	n1.constrained = cloneNodes(n.constrained)
+	n1.handlers = append([]handlerEntry(nil), n.handlers...)
+	n1.around = append([]handlerEntry(nil), n.around...)
+	if n.wild != nil {
+		n1.wild = n.wild.clone()
+	}
+	if n.multi != nil {
+		n1.multi = n.multi.clone()
+	}
+	if n.catchAll != nil {
+		n1.catchAll = n.catchAll.clone()
+	}
+	return &n1
+}
+
+// cloneNodes returns a slice holding a deep copy of each node in ns.
+func cloneNodes(ns []*node) []*node {
+	if ns == nil {
+		return nil
+	}
+	ns1 := make([]*node, len(ns))
+	for i, c := range ns {
+		ns1[i] = c.clone()
+	}
+	return ns1
+}
+
+// checkCatchAllName panics if the catch-all node n already holds
+// routes with a different catch-all variable name from pat.
+func checkCatchAllName(n *node, pat *Pattern) {
+	if err := catchAllNameConflict(n, pat); err != nil {
+		panic(err)
+	}
+}
+
+// catchAllNameConflict returns the error for checkCatchAllName,
+// or nil if there is no conflict.
+func catchAllNameConflict(n *node, pat *Pattern) error {
+	name := pat.vars[len(pat.vars)-1]
+	for _, e := range n.handlers {
+		if oldName := e.pattern.vars[len(e.pattern.vars)-1]; oldName != name {
+			return errgo.Newf("catch-all *%s in %q conflicts with *%s in existing pattern %q", name, pat, oldName, e.pattern)
+		}
+	}
+	return nil
+}
+
+// errDuplicateRoute is used when a route is registered
+// for a method and pattern that already has one.
+var errDuplicateRoute = errors.New("duplicate route")
+
+// handlerConflict returns errDuplicateRoute if adding e to n's
+// handlers would duplicate an existing entry, or nil otherwise.
+func (n *node) handlerConflict(e *handlerEntry) error {
+	if e.around != nil {
+		return nil
+	}
+	for _, oldEntry := range n.handlers {
+		if oldEntry.method == e.method && !oldEntry.opts.constrained() && !e.opts.constrained() {
+			return errDuplicateRoute
+		}
+	}
+	return nil
+}
+
+// checkRoute returns an error if addRoute would fail to add
+// the entry e for the given pattern. It does not change the
+// tree, so it can be used to check a route before adding it.
+func (n *node) checkRoute(pat *Pattern, e *handlerEntry) error {
+	if err := n.checkPattern(pat, e); err != nil {
+		return err
+	}
+	if variant := pat.variant(); variant != nil {
+		return n.checkPattern(variant, e)
+	}
+	return nil
+}
+
+// checkPattern is the counterpart of addPattern for checkRoute.
+// It follows the same path through the tree as addStaticPrefix;
+// if the path leaves the existing nodes, the route will be added
+// to new nodes, so it cannot conflict.
+func (n *node) checkPattern(pat *Pattern, e *handlerEntry) error {
+	prefix, static := pat.static[0], pat.static[1:]
+	for {
+		if !strings.HasPrefix(prefix, n.path) {
+			return nil
+		}
+		prefix = prefix[len(n.path):]
+		if prefix != "" {
+			i := n.childIndex(prefix[0])
+			if i == -1 {
+				return nil
+			}
+			n, prefix = n.child[i], prefix[1:]
+			continue
+		}
+		if len(static) == 0 {
+			return n.handlerConflict(e)
+		}
+		var c *node
+		v := len(pat.vars) - (len(static)+1)/2
+		if len(static) == 1 && pat.catchAll {
+			c = n.catchAll
+			if c != nil {
+				if err := catchAllNameConflict(c, e.pattern); err != nil {
+					return err
+				}
+			}
+		} else if pat.isMulti(v) {
+			c = n.multi
+		} else if oc := pat.constraintAt(v); oc != nil {
+			for _, cn := range n.constrained {
+				if cn.constraint.src == oc.src {
+					c = cn
+					break
+				}
+			}
+		} else {
+			c = n.wild
+		}
+		if c == nil {
+			return nil
+		}
+		n, static = c, static[1:]
+		if len(static) == 0 {
+			return n.handlerConflict(e)
+		}
+		prefix, static = static[0], static[1:]
+	}
+}
+
+// noteParams records that a route with n parameters
+// at or below n passes through n.
+func (n *node) noteParams(nparams int) {
+	if nparams > n.maxParams {
+		n.maxParams = nparams
+	}
 }
 
-func (n *node) setHandler(method string, h Handler, pat *Pattern) {
-	oldEntry := n.entryForMethod(method)
-	if oldEntry != nil && oldEntry.method == method {
-		panic("duplicate route")
+// constrainedSlot returns the slot in n.constrained that holds the
+// node for the given constraint, adding a new node if needed.
+func (n *node) constrainedSlot(c *constraint) **node {
+	for i, cn := range n.constrained {
+		if cn.constraint.src == c.src {
+			return &n.constrained[i]
+		}
 	}
-	n.handlers = append(n.handlers, handlerEntry{
-		method:  method,
-		handler: h,
-		pattern: pat,
+	// Keep the nodes in the order that they are tried so that
+	// the result does not depend on the order of registration.
+	i := sort.Search(len(n.constrained), func(i int) bool {
+		return constraintLess(c, n.constrained[i].constraint)
 	})
-	if oldEntry == nil {
+	n.constrained = append(n.constrained, nil)
+	copy(n.constrained[i+1:], n.constrained[i:])
+	n.constrained[i] = &node{
+		constraint: c,
+	}
+	return &n.constrained[i]
+}
+
+// constraintLess reports whether a wildcard with constraint c
+// should be tried before one with constraint c1. Constraints
+// that match only literal text come first, then the others in
+// lexical order of their source.
+func constraintLess(c, c1 *constraint) bool {
+	if lit, lit1 := c.literal(), c1.literal(); lit != lit1 {
+		return lit
+	}
+	return c.src < c1.src
+}
+
+func (n *node) setHandler(e handlerEntry) {
+	if e.around != nil {
+		n.around = append(n.around, e)
 		return
 	}
-	// There was an old matching entry which must be a
-	// wildcard method at the end of the slice, so keep it
-	// at the end by swapping it with the entry we've just
-	// added. This means we can continue to do a simple
-	// linear search in entryForMethod and have it pick up
-	// the non-wildcard-method handlers first.
-	hlen := len(n.handlers)
-	n.handlers[hlen-2], n.handlers[hlen-1] = n.handlers[hlen-1], n.handlers[hlen-2]
+	if err := n.handlerConflict(&e); err != nil {
+		panic(err)
+	}
+	n.handlers = append(n.handlers, e)
+	// Keep the entries in rank order, so that we can continue
+	// to do a simple linear search in entryForMethod and
+	// have it pick up the non-wildcard-method handlers first,
+	// and the handlers with request constraints before those
+	// without. Handlers with tighter content length limits come
+	// first so that the result does not depend on the order
+	// of registration.
+	sort.SliceStable(n.handlers, func(i, j int) bool {
+		ei, ej := &n.handlers[i], &n.handlers[j]
+		if ri, rj := ei.rank(), ej.rank(); ri != rj {
+			return ri < rj
+		}
+		return ei.opts.MaxContentLength < ej.opts.MaxContentLength
+	})
 }
 
+// addChild adds n1 as a child of n with the given first byte,
+// keeping n.firstBytes sorted, and returns its index.
 func (n *node) addChild(firstByte byte, n1 *node) int {
-	n.child = append(n.child, n1)
-	n.firstBytes = append(n.firstBytes, firstByte)
-	return len(n.child) - 1
+	if firstByte != '/' {
+		n.inSegmentChild = true
+	}
+	i := sort.Search(len(n.firstBytes), func(i int) bool {
+		return n.firstBytes[i] >= firstByte
+	})
+	n.child = append(n.child, nil)
+	copy(n.child[i+1:], n.child[i:])
+	n.child[i] = n1
+	n.firstBytes = append(n.firstBytes, 0)
+	copy(n.firstBytes[i+1:], n.firstBytes[i:])
+	n.firstBytes[i] = firstByte
+	return i
+}
+
+// linearChildSearchMax holds the maximum number of children
+// for which childIndex uses a linear search.
+const linearChildSearchMax = 8
+
+// childIndex returns the index of the child of n with the
+// given first byte, or -1 if there is none.
+func (n *node) childIndex(b byte) int {
+	if len(n.firstBytes) <= linearChildSearchMax {
+		return bytes.IndexByte(n.firstBytes, b)
+	}
+	lo, hi := 0, len(n.firstBytes)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		switch c := n.firstBytes[m]; {
+		case c == b:
+			return m
+		case c < b:
+			lo = m + 1
+		default:
+			hi = m
+		}
+	}
+	return -1
 }
 
-func (n *node) lookup(path string, maxParams int) (*node, Params) {
+// removeRoute removes any handler entries registered for the given
+// method with the given pattern, pruning any nodes that are
+// left empty. If around is true, the entries registered with
+// HandleAround are removed instead. It returns the entries
+// that were removed.
+func (n *node) removeRoute(pat *Pattern, method string, around bool) []handlerEntry {
+	removed := n.removePattern(pat, pat, method, around)
+	if variant := pat.variant(); variant != nil {
+		n.removePattern(variant, pat, method, around)
+	}
+	return removed
+}
+
+// removePattern is the counterpart of addPattern for removeRoute.
+func (n *node) removePattern(pat, orig *Pattern, method string, around bool) []handlerEntry {
+	var prefix string
+	pat1 := *pat
+	prefix, pat1.static = pat1.static[0], pat1.static[1:]
+	return n.removeStaticPrefix(prefix, &pat1, orig, method, around)
+}
+
+// removeStaticPrefix is the counterpart of addStaticPrefix
+// for removeRoute. The orig parameter holds the pattern
+// being removed.
+func (n *node) removeStaticPrefix(prefix string, pat, orig *Pattern, method string, around bool) []handlerEntry {
+	if !strings.HasPrefix(prefix, n.path) {
+		return nil
+	}
+	prefix = prefix[len(n.path):]
+	if prefix != "" {
+		i := n.childIndex(prefix[0])
+		if i == -1 {
+			return nil
+		}
+		c := n.child[i]
+		removed := c.removeStaticPrefix(prefix[1:], pat, orig, method, around)
+		if len(removed) > 0 {
+			if c.isEmpty() {
+				n.child = append(n.child[:i], n.child[i+1:]...)
+				n.firstBytes = append(n.firstBytes[:i], n.firstBytes[i+1:]...)
+			}
+			n.recomputeParams(false)
+		}
+		return removed
+	}
+	if len(pat.static) == 0 {
+		return n.removeHandler(orig, method, around)
+	}
+	wildPt := &n.wild
+	v := len(pat.vars) - (len(pat.static)+1)/2
+	constrainedIndex := -1
+	if len(pat.static) == 1 && pat.catchAll {
+		wildPt = &n.catchAll
+	} else if pat.isMulti(v) {
+		wildPt = &n.multi
+	} else if oc := pat.constraintAt(v); oc != nil {
+		for i, cn := range n.constrained {
+			if cn.constraint.src == oc.src {
+				wildPt, constrainedIndex = &n.constrained[i], i
+				break
+			}
+		}
+		if constrainedIndex == -1 {
+			return nil
+		}
+	}
+	c := *wildPt
+	if c == nil {
+		return nil
+	}
+	pat1 := *pat
+	pat1.static = pat1.static[1:]
+	var removed []handlerEntry
+	if len(pat1.static) == 0 {
+		removed = c.removeHandler(orig, method, around)
+	} else {
+		prefix, pat1.static = pat1.static[0], pat1.static[1:]
+		removed = c.removeStaticPrefix(prefix, &pat1, orig, method, around)
+	}
+	if len(removed) > 0 {
+		if c.isEmpty() {
+			if constrainedIndex >= 0 {
+				n.constrained = append(n.constrained[:constrainedIndex], n.constrained[constrainedIndex+1:]...)
+			} else {
+				*wildPt = nil
+			}
+		} else {
+			c.recomputeParams(true)
+		}
+		n.recomputeParams(false)
+	}
+	return removed
+}
+
+// recomputeParams recalculates n.maxParams from its descendants
+// after a route has been removed below n. The wild parameter
+// holds whether n is a wildcard node, in which case the
+// parameter it matches itself is counted too.
+func (n *node) recomputeParams(wild bool) {
+	nparams := 0
+	for _, c := range n.child {
+		nparams = max(nparams, c.maxParams)
+	}
+	for _, c := range n.constrained {
+		nparams = max(nparams, c.maxParams)
+	}
+	for _, c := range []*node{n.wild, n.multi, n.catchAll} {
+		if c != nil {
+			nparams = max(nparams, c.maxParams)
+		}
+	}
+	for _, e := range n.handlers {
+		nparams = max(nparams, e.pattern.numGroups())
+	}
+	if wild {
+		nparams++
+	}
+	n.maxParams = nparams
+}
+
+// removeHandler removes all the entries in n registered for the
+// given method with a pattern equivalent to pat and returns them.
+// If around is true, the entries registered with HandleAround are
+// removed instead.
+func (n *node) removeHandler(pat *Pattern, method string, around bool) (removed []handlerEntry) {
+	if around {
+		n.around, removed = removeEntries(n.around, pat, method)
+	} else {
+		n.handlers, removed = removeEntries(n.handlers, pat, method)
+	}
+	return removed
+}
+
+// removeEntries removes the entries in entries registered for
+// the given method with a pattern equivalent to pat. It returns
+// the remaining entries and the removed ones.
+func removeEntries(entries []handlerEntry, pat *Pattern, method string) ([]handlerEntry, []handlerEntry) {
+	patStr := pat.String()
+	var removed []handlerEntry
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.method == method && e.pattern.String() == patStr {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	// Clear the tail so that removed entries can be garbage collected.
+	for i := len(kept); i < len(entries); i++ {
+		entries[i] = handlerEntry{}
+	}
+	return kept, removed
+}
+
+// aroundOnly reports whether n holds middleware registered with
+// HandleAround but no handlers. Such a node is not a route, so a
+// lookup that ends there falls back to any catch-all instead.
+func (n *node) aroundOnly() bool {
+	return len(n.handlers) == 0 && len(n.around) > 0
+}
+
+// isEmpty reports whether n has no handlers and no descendants.
+func (n *node) isEmpty() bool {
+	return len(n.handlers) == 0 && len(n.around) == 0 && len(n.child) == 0 && n.wild == nil && len(n.constrained) == 0 && n.multi == nil && n.catchAll == nil
+}
+
+// paramsAlloc determines how parameters are
+// allocated when looking up a path.
+type paramsAlloc struct {
+	// new holds a function to allocate the parameters.
+	// If it is nil, make is used.
+	new func(n int) Params
+
+	// buf, if non-nil, holds memory to be reused
+	// for the parameters. It is used in preference to new.
+	buf *Params
+
+	// exclude holds patterns whose routes should be
+	// ignored by the lookup because their handlers
+	// have already declined the request with ErrPass.
+	exclude []*Pattern
+}
+
+// alloc returns a new zero-length Params with
+// space for at least n parameters.
+func (a paramsAlloc) alloc(n int) Params {
+	switch {
+	case a.buf != nil:
+		if cap(*a.buf) < n {
+			*a.buf = make(Params, 0, n)
+		}
+		return (*a.buf)[:0]
+	case a.new != nil:
+		return a.new(n)
+	}
+	return make(Params, 0, n)
+}
+
+func (n *node) lookup(path string, alloc paramsAlloc) (*node, Params) {
+	return n.lookupWithParams(path, nil, alloc)
+}
+
+// lookupWithParams is like lookup except that any
+// parameters found are appended to params.
+func (n *node) lookupWithParams(path string, params Params, alloc paramsAlloc) (*node, Params) {
 	origPath := path
-	var params Params
 	var catchAll *node
 	var catchAllPath string
 	var catchAllParams Params
@@ -168,6 +737,9 @@ lookupLoop:
 			break
 		}
 		if path == "" {
+			if n.excluded(alloc.exclude) || n.aroundOnly() {
+				break
+			}
 			return n, params
 		}
 		if n.catchAll != nil {
@@ -175,15 +747,12 @@ lookupLoop:
 			catchAll = n.catchAll
 			catchAllParams = params
 		}
-		first := path[0]
-		for i, b := range n.firstBytes {
-			if first == b {
-				path = path[1:]
-				n = n.child[i]
-				continue lookupLoop
-			}
+		if i := n.childIndex(path[0]); i >= 0 {
+			path = path[1:]
+			n = n.child[i]
+			continue lookupLoop
 		}
-		if n.wild == nil {
+		if n.wild == nil && n.multi == nil && len(n.constrained) == 0 {
 			break
 		}
 		elem, rest := pathElem(path)
@@ -191,7 +760,56 @@ lookupLoop:
 			break
 		}
 		if params == nil {
-			params = make(Params, 0, maxParams)
+			params = alloc.alloc(n.maxParams)
+		}
+		if len(n.constrained) > 0 {
+			// Constrained wildcards take precedence over
+			// unconstrained ones, but as with multi-segment
+			// wildcards below, we can't know whether one
+			// will match without trying it.
+			for _, c := range n.constrained {
+				if !c.constraint.re.MatchString(elem) {
+					continue
+				}
+				found, foundParams := c.lookupWithParams(rest, append(params, Param{
+					Value: elem,
+				}), alloc)
+				if found != nil && len(found.handlers) > 0 {
+					return found, foundParams
+				}
+			}
+			if n.wild == nil && n.multi == nil {
+				break
+			}
+		}
+		if n.multi != nil {
+			// A single-segment wildcard takes precedence over
+			// a multi-segment wildcard, but we can't know
+			// whether it will match without trying it, because
+			// the multi-segment wildcard might match
+			// even if the single-segment wildcard does not.
+			if n.wild != nil {
+				if n.wild.inSegmentChild {
+					if found, foundParams := n.wild.lookupInSegment(path, elem, params, alloc); found != nil {
+						return found, foundParams
+					}
+				}
+				found, foundParams := n.wild.lookupWithParams(rest, append(params, Param{
+					Value: elem,
+				}), alloc)
+				if found != nil && len(found.handlers) > 0 {
+					return found, foundParams
+				}
+			}
+			if found, foundParams := n.multi.lookupMulti(path, params, alloc); found != nil {
+				return found, foundParams
+			}
+			break
+		}
+		if n.wild.inSegmentChild {
+			if found, foundParams := n.wild.lookupInSegment(path, elem, params, alloc); found != nil {
+				return found, foundParams
+			}
 		}
 		params = append(params, Param{
 			Value: elem,
@@ -199,10 +817,13 @@ lookupLoop:
 		path = rest
 		n = n.wild
 	}
-	if catchAll != nil {
+	if catchAll != nil && !catchAll.excluded(alloc.exclude) {
 		// The catchAll path needs to include the / that precedes it.
 		// We're guaranteed that there *is* a preceding / because
 		// the pattern parsing ensures it.
+		if catchAllParams == nil {
+			catchAllParams = alloc.alloc(1)
+		}
 		params = append(catchAllParams, Param{
 			Value: origPath[len(origPath)-len(catchAllPath)-1:],
 		})
@@ -211,48 +832,313 @@ lookupLoop:
 	return nil, nil
 }
 
+// lookupInSegment looks up the given path in the wildcard node n,
+// trying values for the wildcard that end inside the first path
+// element, elem, where one of n's children might match the rest of
+// the element. Longer values are tried first.
+func (n *node) lookupInSegment(path, elem string, params Params, alloc paramsAlloc) (*node, Params) {
+	for i := len(elem) - 1; i > 0; i-- {
+		if n.childIndex(elem[i]) == -1 {
+			continue
+		}
+		found, foundParams := n.lookupWithParams(path[i:], append(params, Param{
+			Value: elem[:i],
+		}), alloc)
+		if found != nil && len(found.handlers) > 0 {
+			return found, foundParams
+		}
+	}
+	return nil, nil
+}
+
+// lookupMulti looks up the given path in the multi-segment wildcard
+// node n, trying the longest possible wildcard value first. The path
+// starts at the beginning of the first segment to be matched by the
+// wildcard. At least one segment must be left for the static segment
+// that follows the wildcard.
+func (n *node) lookupMulti(path string, params Params, alloc paramsAlloc) (*node, Params) {
+	for i := strings.LastIndexByte(path, '/'); i > 0; i = strings.LastIndexByte(path[:i], '/') {
+		found, foundParams := n.lookupWithParams(path[i:], append(params, Param{
+			Value: path[:i],
+		}), alloc)
+		if found != nil && len(found.handlers) > 0 {
+			return found, foundParams
+		}
+	}
+	return nil, nil
+}
+
 // getValue looks up the given path and method and
-// returns any handler found along with the parameters
-// to be passed to that handler.
+// returns any handler entry found along with the parameters
+// to be passed to its handler.
 // It also returns any node found for the path, even if no handler
 // was found.
-func (n *node) getValue(method, path string, maxParams int) (h Handler, p Params, pat *Pattern, foundNode *node) {
-	foundNode, params := n.lookup(path, maxParams)
+//
+// If req is non-nil, it is used to check any request-dependent
+// route options.
+func (n *node) getValue(method, path string, req *http.Request, alloc paramsAlloc) (e *handlerEntry, p Params, foundNode *node) {
+	foundNode, params := n.lookup(path, alloc)
 	if foundNode == nil {
-		return nil, nil, nil, nil
+		return nil, nil, nil
 	}
-	entry := foundNode.entryForMethod(method)
+	entryNode := foundNode
+	entry := foundNode.entryForMethod(method, req, alloc.exclude)
 	if entry == nil {
 		// No handler found directly in this node, but if
 		// there's a catchAll handler, we can fall back to that.
 		if foundNode.catchAll == nil {
 			// No catchAll handler to fall back to.
-			return nil, nil, nil, foundNode
+			return nil, nil, foundNode
 		}
-		entry = foundNode.catchAll.entryForMethod(method)
+		entryNode = foundNode.catchAll
+		entry = entryNode.entryForMethod(method, req, alloc.exclude)
 		if entry == nil {
-			return nil, nil, nil, foundNode
+			return nil, nil, foundNode
+		}
+		if params == nil {
+			params = alloc.alloc(1)
 		}
 		params = append(params, Param{
 			Value: "/",
 		})
 	}
+	if len(entryNode.around) > 0 {
+		entry = entryNode.wrapAround(entry, method)
+	}
+	if nvars := len(entry.pattern.vars); len(params) < nvars {
+		// The entry serves the form of a pattern without its
+		// final optional wildcard, which has an empty value.
+		if params == nil {
+			params = alloc.alloc(nvars)
+		}
+		params = append(params, Param{})
+	}
 	if len(params) == 0 {
-		return entry.handler, nil, entry.pattern, foundNode
+		return entry, nil, foundNode
 	}
+	params = entry.pattern.addGroups(params)
 	// Fill in the keys that were used to register this particular
 	// handler.
 	for i, key := range entry.pattern.Keys() {
 		params[i].Key = key
 	}
-	return entry.handler, params, entry.pattern, foundNode
+	return entry, params, foundNode
 }
 
-func (n *node) findCaseInsensitivePath(path string, redir bool) (string, bool) {
-	// TODO
+// addStats adds statistics for the tree rooted at n,
+// which is at the given depth, to stats.
+func (n *node) addStats(stats *Stats, depth int) {
+	stats.Nodes++
+	for _, e := range n.handlers {
+		if !e.variant {
+			stats.Routes++
+		}
+	}
+	if depth > stats.MaxDepth {
+		stats.MaxDepth = depth
+	}
+	if n.maxParams > stats.MaxParams {
+		stats.MaxParams = n.maxParams
+	}
+	for _, c := range n.child {
+		c.addStats(stats, depth+1)
+	}
+	for _, c := range n.constrained {
+		c.addStats(stats, depth+1)
+	}
+	for _, c := range []*node{n.wild, n.multi, n.catchAll} {
+		if c != nil {
+			c.addStats(stats, depth+1)
+		}
+	}
+}
+
+// wrapAround returns a copy of e, which is held in n, with its
+// handler wrapped by the middleware of each entry in n.around
+// that applies to the given method. It returns e itself if
+// there is none.
+func (n *node) wrapAround(e *handlerEntry, method string) *handlerEntry {
+	var e1 *handlerEntry
+	for i := len(n.around) - 1; i >= 0; i-- {
+		a := &n.around[i]
+		if a.method != "*" && a.method != method {
+			continue
+		}
+		if e1 == nil {
+			e1 = new(handlerEntry)
+			*e1 = *e
+		}
+		e1.handler = a.around(e1.handler)
+	}
+	if e1 == nil {
+		return e
+	}
+	return e1
+}
+
+// prefixNode returns the node in the tree rooted at n below which are
+// all the routes whose static text starts with prefix, or nil if there
+// are none.
+func (n *node) prefixNode(prefix string) *node {
+	for {
+		if len(prefix) <= len(n.path) {
+			if !strings.HasPrefix(n.path, prefix) {
+				return nil
+			}
+			return n
+		}
+		if !strings.HasPrefix(prefix, n.path) {
+			return nil
+		}
+		prefix = prefix[len(n.path):]
+		i := n.childIndex(prefix[0])
+		if i == -1 {
+			return nil
+		}
+		n = n.child[i]
+		prefix = prefix[1:]
+	}
+}
+
+// walk calls fn for each handler entry in the tree rooted at n,
+// stopping early if fn returns false. It reports whether
+// the traversal completed.
+func (n *node) walk(fn func(e *handlerEntry) bool) bool {
+	for i := range n.handlers {
+		if n.handlers[i].variant {
+			continue
+		}
+		if !fn(&n.handlers[i]) {
+			return false
+		}
+	}
+	for _, c := range n.child {
+		if !c.walk(fn) {
+			return false
+		}
+	}
+	for _, c := range n.constrained {
+		if !c.walk(fn) {
+			return false
+		}
+	}
+	if n.wild != nil && !n.wild.walk(fn) {
+		return false
+	}
+	if n.multi != nil && !n.multi.walk(fn) {
+		return false
+	}
+	if n.catchAll != nil && !n.catchAll.walk(fn) {
+		return false
+	}
+	return true
+}
+
+// findCaseInsensitivePath looks up the given path ignoring the case of
+// ASCII letters in static segments and returns the path with the
+// static segments in their registered case. Wildcard values are
+// preserved as is. If fixTrailingSlash is true, a path with a
+// trailing slash added or removed will also be found.
+func (n *node) findCaseInsensitivePath(path string, fixTrailingSlash bool) (string, bool) {
+	buf := make([]byte, 0, len(path)+1)
+	if fixed, ok := n.fixPathCase(path, buf); ok {
+		return string(fixed), true
+	}
+	if !fixTrailingSlash {
+		return "", false
+	}
+	if strings.HasSuffix(path, "/") {
+		path = path[:len(path)-1]
+	} else {
+		path += "/"
+	}
+	if fixed, ok := n.fixPathCase(path, buf); ok {
+		return string(fixed), true
+	}
 	return "", false
 }
 
+// fixPathCase is the recursive helper for findCaseInsensitivePath.
+// It appends the correctly cased path to buf and returns the result.
+// Static children are tried before wildcards in the same order
+// as lookupWithParams.
+func (n *node) fixPathCase(path string, buf []byte) ([]byte, bool) {
+	if len(path) < len(n.path) || !asciiEqualFold(path[:len(n.path)], n.path) {
+		return nil, false
+	}
+	buf = append(buf, n.path...)
+	path = path[len(n.path):]
+	if path == "" {
+		if len(n.handlers) > 0 || n.catchAll != nil && len(n.catchAll.handlers) > 0 {
+			return buf, true
+		}
+		return nil, false
+	}
+	first := asciiLower(path[0])
+	for i, b := range n.firstBytes {
+		if asciiLower(b) != first {
+			continue
+		}
+		if fixed, ok := n.child[i].fixPathCase(path[1:], append(buf, b)); ok {
+			return fixed, true
+		}
+	}
+	if elem, rest := pathElem(path); elem != "" {
+		for _, c := range n.constrained {
+			if !c.constraint.re.MatchString(elem) {
+				continue
+			}
+			if fixed, ok := c.fixPathCase(rest, append(buf, elem...)); ok {
+				return fixed, true
+			}
+		}
+		if n.wild != nil {
+			if n.wild.inSegmentChild {
+				for i := len(elem) - 1; i > 0; i-- {
+					if fixed, ok := n.wild.fixPathCase(path[i:], append(buf, elem[:i]...)); ok {
+						return fixed, true
+					}
+				}
+			}
+			if fixed, ok := n.wild.fixPathCase(rest, append(buf, elem...)); ok {
+				return fixed, true
+			}
+		}
+		if n.multi != nil {
+			for i := strings.LastIndexByte(path, '/'); i > 0; i = strings.LastIndexByte(path[:i], '/') {
+				if fixed, ok := n.multi.fixPathCase(path[i:], append(buf, path[:i]...)); ok {
+					return fixed, true
+				}
+			}
+		}
+	}
+	if n.catchAll != nil && len(n.catchAll.handlers) > 0 {
+		return append(buf, path...), true
+	}
+	return nil, false
+}
+
+// asciiEqualFold reports whether s and t, which
+// must be the same length, are equal ignoring the case
+// of ASCII letters.
+func asciiEqualFold(s, t string) bool {
+	for i := 0; i < len(s); i++ {
+		if asciiLower(s[i]) != asciiLower(t[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiLower returns the lower case version of b
+// if it is an ASCII upper case letter.
+func asciiLower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
+
 // commonPrefix returns any prefix that s and t
 // have in common.
 func commonPrefix(s, t string) string {
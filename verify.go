@@ -0,0 +1,202 @@
+package hroute
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"unicode"
+)
+
+// Warning describes a problem with a registered route
+// found by Router.Verify.
+type Warning struct {
+	// Host holds the host the route was registered for
+	// with Router.Host, or the empty string if it was
+	// registered directly on the router.
+	Host string
+
+	// Method holds the method the route was registered with.
+	Method string
+
+	// Pattern holds the pattern the route was registered with.
+	Pattern *Pattern
+
+	// Message describes the problem.
+	Message string
+}
+
+// String returns a description of the warning suitable
+// for printing.
+func (w Warning) String() string {
+	s := fmt.Sprintf("%s %s: %s", w.Method, w.Pattern, w.Message)
+	if w.Host != "" {
+		s = w.Host + ": " + s
+	}
+	return s
+}
+
+// Verify walks the routes registered with the router, including
+// those registered with Router.Host, and returns a warning for
+// each route that can never be reached. It reports:
+//
+//   - routes that are always served by another entry registered
+//     earlier for the same path and method (including
+//     wildcard-method "*" entries overridden by another "*" entry);
+//   - wildcard routes whose final segment is always taken by a
+//     constrained wildcard whose expression matches any segment,
+//     such as :name([^\x2f]+) or :name((?s).+);
+//   - routes that can only match paths longer than
+//     Router.MaxPathLength.
+//
+// Verify is intended for use in tests and during development;
+// the returned warnings are sorted by host, then by pattern
+// and then by method.
+func (r *Router) Verify() []Warning {
+	var warnings []Warning
+	check := func(host string, root *node) {
+		root.verify(r, func(e *handlerEntry, msg string) {
+			warnings = append(warnings, Warning{
+				Host:    host,
+				Method:  e.method,
+				Pattern: e.pattern,
+				Message: msg,
+			})
+		})
+	}
+	check("", r.tree())
+	for host, root := range r.hosts {
+		check(host, root)
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		wi, wj := warnings[i], warnings[j]
+		if wi.Host != wj.Host {
+			return wi.Host < wj.Host
+		}
+		pi, pj := wi.Pattern.String(), wj.Pattern.String()
+		if pi != pj {
+			return pi < pj
+		}
+		return wi.Method < wj.Method
+	})
+	return warnings
+}
+
+// verify calls warn for each problem found in the routes at or below n.
+func (n *node) verify(r *Router, warn func(e *handlerEntry, msg string)) {
+	for i := range n.handlers {
+		e := &n.handlers[i]
+		if e.variant {
+			continue
+		}
+		// The handlers are held in rank order, so an entry can only
+		// be overridden by one that precedes it.
+		for j := range n.handlers[:i] {
+			e1 := &n.handlers[j]
+			if (e1.method == "*" || e1.method == e.method) && e1.opts.covers(&e.opts) {
+				warn(e, fmt.Sprintf("always overridden by %s %s", e1.method, e1.pattern))
+				break
+			}
+		}
+		if r.MaxPathLength > 0 {
+			if size := minPathLength(e.pattern); size > r.MaxPathLength {
+				warn(e, fmt.Sprintf("shortest matching path (%d bytes) is longer than MaxPathLength (%d)", size, r.MaxPathLength))
+			}
+		}
+	}
+	// Constrained wildcards are tried in order before the unconstrained
+	// wildcard, and the first one that matches a final segment wins
+	// even if it has no handler for the request's method.
+	var shadow *node
+	for _, c := range n.constrained {
+		if c.path != "" || len(c.handlers) == 0 {
+			continue
+		}
+		if shadow != nil {
+			warnShadowed(c, shadow, warn)
+		} else if matchesAnySegment(c.constraint) {
+			shadow = c
+		}
+	}
+	if shadow != nil && n.wild != nil && n.wild.path == "" {
+		warnShadowed(n.wild, shadow, warn)
+	}
+	for _, c := range n.child {
+		c.verify(r, warn)
+	}
+	for _, c := range n.constrained {
+		c.verify(r, warn)
+	}
+	for _, c := range []*node{n.wild, n.multi, n.catchAll} {
+		if c != nil {
+			c.verify(r, warn)
+		}
+	}
+}
+
+// warnShadowed calls warn for each route in n, which
+// can never be reached because of the constrained
+// wildcard node shadow.
+func warnShadowed(n, shadow *node, warn func(e *handlerEntry, msg string)) {
+	for i := range n.handlers {
+		if e := &n.handlers[i]; !e.variant {
+			warn(e, fmt.Sprintf("shadowed by %s, whose constraint matches any segment", shadow.handlers[0].pattern))
+		}
+	}
+}
+
+// minPathLength returns the length of the shortest
+// path that can match p.
+func minPathLength(p *Pattern) int {
+	if p.optional {
+		p = p.withoutOptional()
+	}
+	size := p.staticSize
+	for i := range p.vars {
+		if !p.catchAll || i < len(p.vars)-1 {
+			// Every other kind of wildcard matches
+			// at least one byte.
+			size++
+		}
+	}
+	return size
+}
+
+// matchesAnySegment reports whether the constraint
+// matches any non-empty path segment.
+func matchesAnySegment(c *constraint) bool {
+	re, err := syntax.Parse(c.src, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	if re.Op != syntax.OpPlus && re.Op != syntax.OpStar {
+		return false
+	}
+	switch sub := re.Sub[0]; sub.Op {
+	case syntax.OpAnyChar:
+		return true
+	case syntax.OpCharClass:
+		return classCoversSegment(sub.Rune)
+	}
+	return false
+}
+
+// classCoversSegment reports whether the character class
+// with the given ranges includes every rune except
+// possibly '/'.
+func classCoversSegment(ranges []rune) bool {
+	next := rune(0)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo > next && !(lo == '/'+1 && next == '/') {
+			return false
+		}
+		if hi+1 > next {
+			next = hi + 1
+		}
+	}
+	return next > unicode.MaxRune
+}
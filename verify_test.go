@@ -0,0 +1,51 @@
+package hroute_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rogpeppe/hroute"
+)
+
+func TestVerify(t *testing.T) {
+	r := hroute.New()
+	r.MaxPathLength = 20
+	r.Handle("POST", "/upload", nopHandler("big"), hroute.WithMaxContentLength(1000))
+	r.Handle("POST", "/upload", nopHandler("small"), hroute.WithMaxContentLength(100))
+	r.Handle("POST", "/upload", nopHandler("same"), hroute.WithMaxContentLength(100))
+	r.Handle("POST", "/upload", nopHandler("any"))
+	r.HandleAny("/any", nopHandler("any"))
+	r.Handle("*", "/any", nopHandler("limited"), hroute.WithMaxContentLength(100))
+	r.Handle("*", "/any", nopHandler("small"), hroute.WithMaxContentLength(10))
+	r.Handle("GET", `/a/:id([^\x2f]+)`, nopHandler("id"))
+	r.Handle("GET", "/a/:name(x.*)", nopHandler("name"))
+	r.Handle("PUT", "/a/:x", nopHandler("x"))
+	r.Handle("GET", "/b/:id(.+)", nopHandler("id"))
+	r.Handle("GET", "/b/:x", nopHandler("x"))
+	r.Handle("GET", "/a/very/long/path/name", nopHandler("long"))
+	r.Handle("GET", "/long/*rest", nopHandler("rest"))
+	r.Handle("GET", "/a-rather-long-name/:x", nopHandler("long"))
+	r.Handle("GET", "/a-rather-long-name/*rest", nopHandler("rest"))
+	r.Host("example.com").Handle("GET", "/c/:id((?s).*)", nopHandler("id"))
+	r.Host("example.com").Handle("GET", "/c/:x", nopHandler("x"))
+
+	var got []string
+	for _, w := range r.Verify() {
+		got = append(got, w.String())
+	}
+	want := []string{
+		`GET /a-rather-long-name/:x: shortest matching path (21 bytes) is longer than MaxPathLength (20)`,
+		`GET /a/:name(x.*): shadowed by /a/:id([^\x2f]+), whose constraint matches any segment`,
+		`PUT /a/:x: shadowed by /a/:id([^\x2f]+), whose constraint matches any segment`,
+		`GET /a/very/long/path/name: shortest matching path (22 bytes) is longer than MaxPathLength (20)`,
+		`POST /upload: always overridden by POST /upload`,
+		`example.com: GET /c/:x: shadowed by /c/:id((?s).*), whose constraint matches any segment`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected warnings; got\n%q\nwant\n%q", got, want)
+	}
+
+	if ws := hroute.New().Verify(); len(ws) != 0 {
+		t.Errorf("unexpected warnings for empty router: %q", ws)
+	}
+}